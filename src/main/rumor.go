@@ -1,15 +1,23 @@
 package main
 
 import (
-	"io"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"service"
+	"simulator"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/docopt/docopt-go"
 )
@@ -18,37 +26,84 @@ import (
 const VERSION = `0.1.0 alpha`
 
 type config struct {
-	Start     bool
-	File      string
-	Stop      bool
-	Node      bool
-	Self      bool
-	Add       bool
-	List      bool
-	BucketIdx int `docopt:"<bucket-index>"`
-	Ping      bool
-	NodeStr   string `docopt:"<node-string>"`
-	Update    bool
-	NodeID    string `docopt:"<NodeID>"`
+	Home       string
+	Start      bool
+	File       string
+	ConfigFile string   `docopt:"--config"`
+	Set        []string `docopt:"--set"`
+	Stop       bool
+	Node       bool
+	Self       bool
+	Add        bool
+	List       bool
+	BucketIdx  int `docopt:"<bucket-index>"`
+	Ping       bool
+	NodeStr    string `docopt:"<node-string>"`
+	Update     bool
+	NodeID     string `docopt:"<NodeID>"`
+	Connect    bool
+	XMPP       string `docopt:"--xmpp"`
+	Signal     bool
+	JID        string `docopt:"<jid>"`
+	Relay      bool
+	ServeRelay bool
+	ConfigCmd  bool `docopt:"config"`
+	Show       bool
+	Stats      bool
+	Events     bool
+	Follow     bool
+	Simulate   bool
+	Nodes      int
+	Steps      int
+	Interval   float64
+	Churn      float64
+	Lookups    int
+	NAT        float64 `docopt:"--nat"`
+	Latency    float64
+	Loss       float64
+	Seed       int
 }
 
 const usage = `Rumor.
 
 Usage:
-  rumor start [--file=<path/to/tree>]
-  rumor stop
-  rumor node self
-  rumor node add <node-string>
-  rumor node list <bucket-index>
-  rumor node ping <node-string>
-  rumor node update <NodeID>
+  rumor [--home=<dir>] start [--file=<path/to/tree>] [--config=<path>] [--set=<key=value>...] [--xmpp=<jid>] [--serve-relay]
+  rumor [--home=<dir>] stop
+  rumor [--home=<dir>] config show
+  rumor [--home=<dir>] stats
+  rumor [--home=<dir>] events --follow
+  rumor [--home=<dir>] node self
+  rumor [--home=<dir>] node add <node-string>
+  rumor [--home=<dir>] node list <bucket-index>
+  rumor [--home=<dir>] node ping <node-string>
+  rumor [--home=<dir>] node update <NodeID>
+  rumor [--home=<dir>] node connect <NodeID> <node-string>
+  rumor [--home=<dir>] node signal <jid>
+  rumor [--home=<dir>] node relay <node-string>
+  rumor simulate [--nodes=<n>] [--steps=<n>] [--interval=<sec>] [--churn=<ratio>] [--lookups=<n>] [--nat=<ratio>] [--latency=<ms>] [--loss=<ratio>] [--seed=<n>]
   
 Options:
-  -h --help  Show this screen.
-  --version  Show version.
+  -h --help            Show this screen.
+  --version            Show version.
+  --home=<dir>         Data directory of the instance, defaults to $RUMOR_HOME or ~/.rumor.
+                       It holds config.json, identity, tree and the IPC socket, so instances are told apart by it.
+  --config=<path>      JSON config file instead of config.json in the home directory, missing keys keep default values.
+  --set=<key=value>    Override a config key, e.g. --set=port=54322. Environment variables like RUMOR_PORT override the file too.
+  --xmpp=<jid>         XMPP account for signalling, password is read from RUMOR_XMPP_PASSWORD.
+  --serve-relay        Serve as a relay for peers behind symmetric NATs.
+  --follow             Stream events of the bucket tree and arriving requests until interrupted.
+  --nodes=<n>          Nodes joining a simulated network at the beginning [default: 100].
+  --steps=<n>          Churn steps of the simulation [default: 10].
+  --interval=<sec>     Virtual seconds between churn steps [default: 60].
+  --churn=<ratio>      Fraction of nodes replaced in each step [default: 0.1].
+  --lookups=<n>        Lookups in each step [default: 50].
+  --nat=<ratio>        Fraction of simulated nodes behind port-restricted NATs [default: 0].
+  --latency=<ms>       One-way latency of the simulated network [default: 20].
+  --loss=<ratio>       Packet loss of the simulated network [default: 0].
+  --seed=<n>           Seed of the simulation [default: 1].
   `
 
-func cliHandler(conn net.Conn, server *service.Server) {
+func cliHandler(conn net.Conn, server *service.Server, stopped chan<- struct{}) {
 	defer func() {
 		recover()
 		conn.Write([]byte{0}) // Close conn.
@@ -69,29 +124,53 @@ func cliHandler(conn net.Conn, server *service.Server) {
 	// Handle Req
 	if cfg.Stop {
 		log.Println("user requests to stop.")
-		conn.Write([]byte{0}) // Success and close connection.
-		conn.Close()
-		os.Exit(0)
+		// The daemon exits even if the server does not stop gracefully.
+		if err := stopServer(server); err != nil {
+			log.Printf("failed to stop gracefully: %s\n", err)
+			conn.Write([]byte(err.Error()))
+		}
+		conn.Write([]byte{0}) // Reply before the daemon exits.
+		close(stopped)
+	} else if cfg.ConfigCmd && cfg.Show {
+		data, err := json.MarshalIndent(server.Config(), "", "  ")
+		errHandler(err)
+		conn.Write(data)
+	} else if cfg.Stats {
+		var buffer bytes.Buffer
+		fmt.Fprintf(&buffer, "%-10s %8s %10s %10s", "pool", "queued", "handled", "dropped")
+		for _, stats := range server.PoolStats() {
+			fmt.Fprintf(&buffer, "\n%-10s %8d %10d %10d", stats.Name, stats.Queued, stats.Handled, stats.Dropped)
+		}
+		total, sources := server.Malformed.Stats()
+		fmt.Fprintf(&buffer, "\n\nMalformed packets: %d", total)
+		for i, source := range sources {
+			if i == 10 {
+				fmt.Fprintf(&buffer, "\n  ... %d more sources", len(sources)-i)
+				break
+			}
+			fmt.Fprintf(&buffer, "\n  %-40s %8d  last: %s", source.Source, source.Count, source.LastError)
+		}
+		conn.Write(buffer.Bytes())
+	} else if cfg.Events && cfg.Follow {
+		followEvents(conn, server)
 	} else if cfg.Node {
 		if cfg.Add {
 			var node service.Node
 			err := node.DecodeString(cfg.NodeStr)
 			errHandler(err)
-			server.KBuckets.Add(node.ID, node.Address)
+			errHandler(server.AddNode(&node))
 			log.Println("Successfully add offered new node.")
 		} else if cfg.Self {
-			conn.Write([]byte(server.KBuckets.Self.EncodeToString()))
+			self := server.KBuckets.SelfNode()
+			conn.Write([]byte(fmt.Sprintf("%s\nNAT type: %s\nKeepalive interval: %s", self.EncodeToString(), self.Capabilities.NAT, server.Keepalive.Interval())))
 		} else if cfg.List {
-			bucket := server.KBuckets.Buckets[cfg.BucketIdx]
-			if bucket == nil {
+			nodes := server.KBuckets.BucketNodes(cfg.BucketIdx)
+			if nodes == nil {
 				conn.Write([]byte("Empty bucket."))
 			} else {
 				var buf bytes.Buffer
-				idx := 0
-				for ele := bucket.Queue.Front(); ele != nil; ele = ele.Next() {
-					node := ele.Value.(*service.Node)
+				for idx, node := range nodes {
 					fmt.Fprintf(&buf, "[%d]NodeID: %x\n   NodeString: %s\n", idx, *node.ID, node.EncodeToString())
-					idx++
 				}
 				conn.Write(buf.Bytes())
 			}
@@ -102,23 +181,131 @@ func cliHandler(conn net.Conn, server *service.Server) {
 			conn.Write([]byte(fmt.Sprintf("Ping result: %t\n", server.Ping(&node))))
 		} else if cfg.Update {
 			var nodeID service.NodeID
-			nodeIDSlice, err := hex.DecodeString(cfg.NodeStr)
+			nodeIDSlice, err := hex.DecodeString(cfg.NodeID)
 			errHandler(err)
 			copy(nodeID[:], nodeIDSlice)
-			err := server.KBuckets.Update(&nodeID)
+			err = server.KBuckets.Update(&nodeID)
 			if err != nil {
 				conn.Write([]byte(err.Error()))
 			} else {
 				conn.Write([]byte("Node updated."))
 			}
-		}
+		} else if cfg.Connect {
+			var nodeID service.NodeID
+			nodeIDSlice, err := hex.DecodeString(cfg.NodeID)
+			errHandler(err)
+			copy(nodeID[:], nodeIDSlice)
+			var rendezvous service.Node
+			err = rendezvous.DecodeString(cfg.NodeStr)
+			errHandler(err)
+			peer, err := server.Connect(&nodeID, &rendezvous)
+			errHandler(err)
+			conn.Write([]byte(fmt.Sprintf("Connected to %s", peer)))
+		} else if cfg.Signal {
+			if server.Signaller == nil {
+				errHandler(errors.New("xmpp signalling is not configured"))
+			}
+			peer, err := server.Signaller.Connect(service.JIDAddr(cfg.JID))
+			errHandler(err)
+			conn.Write([]byte(fmt.Sprintf("Connected to %s", peer)))
+		} else if cfg.Relay {
+			var relayNode service.Node
+			err := relayNode.DecodeString(cfg.NodeStr)
+			errHandler(err)
+			err = server.ReserveRelay(&relayNode)
+			errHandler(err)
+			conn.Write([]byte("Relay slot reserved, new node string: " + server.KBuckets.SelfNode().EncodeToString()))
 		}
 	}
 	conn.Write([]byte{0}) // Success and close connection.
 }
 
-func initPrepare() {
-	gob.Register(net.UDPAddr{})
+// followEvents writes events to an IPC connection one per line, until the client goes away.
+func followEvents(conn net.Conn, server *service.Server) {
+	subscription := server.Events.Subscribe(256)
+	defer subscription.Close()
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn) // The client sends nothing more, so reading ends once it goes away.
+		close(closed)
+	}()
+	var dropped uint64
+	for {
+		select {
+		case event := <-subscription.C:
+			var buffer bytes.Buffer
+			if missed := subscription.Dropped(); missed > dropped {
+				fmt.Fprintf(&buffer, "... %d events dropped\n", missed-dropped)
+				dropped = missed
+			}
+			fmt.Fprintf(&buffer, "%s %s\n", server.Clock.Now().Format("2006-01-02 15:04:05.000"), event)
+			if _, err := conn.Write(buffer.Bytes()); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// stopServer stops the server, waiting for in-flight work at most ShutdownTimeout.
+func stopServer(server *service.Server) error {
+	timeout := time.Duration(server.Config().ShutdownTimeout * float64(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Stop(ctx)
+}
+
+// simulate runs a simulation with churn and prints the report.
+func simulate(cfg *config) {
+	log.SetOutput(io.Discard) // Thousands of nodes log too much.
+	milliseconds := func(ms float64) time.Duration {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	scenario := &simulator.Scenario{
+		Seed:     int64(cfg.Seed),
+		Nodes:    cfg.Nodes,
+		Steps:    simulator.ChurnSteps(cfg.Steps, milliseconds(cfg.Interval*1000), cfg.Nodes, cfg.Churn, cfg.Lookups),
+		Latency:  milliseconds(cfg.Latency),
+		Jitter:   milliseconds(cfg.Latency / 4),
+		Loss:     cfg.Loss,
+		NATRatio: cfg.NAT,
+		NATType:  service.NATPortRestricted,
+	}
+	report, err := simulator.New(scenario).Run()
+	if err != nil {
+		fmt.Printf("Simulation failed: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+}
+
+// loadConfig builds the effective config from the config file, environment variables and --set flags in order.
+// The config file defaults to the one in the home directory.
+func loadConfig(cfg *config, home *service.Home) (*service.Config, error) {
+	var serverConfig *service.Config
+	var err error
+	if cfg.ConfigFile != "" {
+		serverConfig, err = service.LoadConfig(cfg.ConfigFile)
+	} else {
+		serverConfig, err = home.LoadConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := serverConfig.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	for _, option := range cfg.Set {
+		pair := strings.SplitN(option, "=", 2)
+		if len(pair) != 2 {
+			return nil, errors.New("illegal option, key=value expected: " + option)
+		}
+		if err := serverConfig.Set(pair[0], pair[1]); err != nil {
+			return nil, err
+		}
+	}
+	return serverConfig, serverConfig.Validate()
 }
 
 func main() {
@@ -128,45 +315,102 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	if cfg.Simulate {
+		simulate(&cfg)
+		return
+	}
+	if cfg.Home == "" {
+		cfg.Home = service.DefaultHomeDir()
+	}
+	home, err := service.OpenHome(cfg.Home)
+	if err != nil {
+		log.Fatalf("failed to open home directory %s: %s\n", cfg.Home, err)
+	}
 
 	// Server part
 	if cfg.Start {
-		initPrepare()
+		serverConfig, err := loadConfig(&cfg, home)
+		if err != nil {
+			log.Fatalf("illegal config: %s\n", err)
+		}
+		nodeID, key, err := home.LoadIdentity()
+		if err != nil {
+			log.Fatalf("failed to load identity: %s\n", err)
+		}
+		if _, err := os.Stat(home.StatePath()); cfg.File == "" && err == nil {
+			cfg.File = home.StatePath()
+		}
 		var tree *service.BucketTree
 		if cfg.File == "" {
 			log.Println("Creating an empty bucket tree.")
-			tree = service.NewBucketTree()
+			tree = service.NewBucketTree(serverConfig)
+			tree.Self.ID = nodeID
 		} else {
 			log.Println("Loading from an existing tree.")
-			fd, err := os.Open(cfg.File)
-			if err != nil {
-				panic(err)
+			tree, err = service.LoadBucketTree(cfg.File, serverConfig)
+			// Buckets are arranged around Self.ID, thus a snapshot of another node cannot be adopted.
+			if err == nil && *tree.Self.ID != *nodeID {
+				err = fmt.Errorf("it belongs to node %x rather than the identity %x", *tree.Self.ID, *nodeID)
 			}
-			dec := gob.NewDecoder(fd)
-			err = dec.Decode(&tree)
 			if err != nil {
-				panic(err)
+				log.Fatalf("failed to load bucket tree %s: %s\n", cfg.File, err)
 			}
 		}
-		server := service.NewServer(tree)
+		server := service.NewServer(tree, serverConfig)
+		if server == nil {
+			log.Fatalf("failed to listen on port %d\n", serverConfig.Port)
+		}
+		server.SnapshotPath = home.StatePath()
 		server.StartService()
-		fmt.Printf("Rumor is running on local node:\nNodeID: %x\nAddress: %s\nNode String: %s\n", *server.KBuckets.Self.ID, server.KBuckets.Self.Address.String(), server.KBuckets.Self.EncodeToString())
-		listener, err := service.NewNamedPipeListener()
+		service.WelcomePrint()
+		if cfg.ServeRelay {
+			server.EnableRelay(serverConfig.RelayMaxSessions, serverConfig.RelayBandwidth)
+		}
+		if cfg.XMPP != "" {
+			account := &service.XMPPAccount{JID: cfg.XMPP, Password: os.Getenv("RUMOR_XMPP_PASSWORD")}
+			pins, err := service.LoadKeyPins(home.KeyPinsPath())
+			if err == nil {
+				_, err = service.NewSignaller(server, account, key, pins)
+			}
+			if err != nil {
+				log.Printf("failed to start xmpp signalling: %s\n", err)
+			}
+		}
+		self := server.KBuckets.SelfNode()
+		fmt.Printf("Rumor is running on local node:\nNodeID: %x\nAddress: %s\nNode String: %s\n", *self.ID, self.Address.String(), self.EncodeToString())
+		listener, err := service.NewNamedPipeListener(home)
 		if err != nil {
 			log.Panic(err)
 		}
-		defer listener.Close()
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				log.Printf("encountered an error when accepting an named pipe connection: %s\n", err)
-				continue
+		stopped := make(chan struct{})
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if err != nil {
+					log.Printf("encountered an error when accepting an named pipe connection: %s\n", err)
+					continue
+				}
+				go cliHandler(conn, server, stopped)
+			}
+		}()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-stopped:
+		case <-signals:
+			log.Println("interrupted, stopping.")
+			if err := stopServer(server); err != nil {
+				log.Printf("failed to stop gracefully: %s\n", err)
 			}
-			go cliHandler(conn, server)
 		}
+		listener.Close()
+		log.Println("Rumor stopped.")
 	} else {
 		// CLI part
-		conn, err := service.DialPipe()
+		conn, err := service.DialPipe(home)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -174,15 +418,31 @@ func main() {
 		enc := gob.NewEncoder(conn)
 		enc.Encode(cfg)
 		buffer := make([]byte, 1024)
+		lastByte := byte('\n')
 		for {
 			n, err := conn.Read(buffer)
 			if err != nil && err != io.EOF {
 				panic(err)
 			}
-			if n == 1 && buffer[0] == 0 {
+			// A zero byte marks the end of the response, which may arrive together with it.
+			// Chunks are printed as they arrive for streams, with a newline at the end if missing.
+			if end := bytes.IndexByte(buffer[:n], 0); end >= 0 {
+				fmt.Print(string(buffer[:end]))
+				if end > 0 {
+					lastByte = buffer[end-1]
+				}
+				if lastByte != '\n' {
+					fmt.Println()
+				}
+				return
+			}
+			if err == io.EOF {
 				return
 			}
-			fmt.Println(string(buffer[:n]))
+			if n > 0 {
+				fmt.Print(string(buffer[:n]))
+				lastByte = buffer[n-1]
+			}
 		}
 	}
 }
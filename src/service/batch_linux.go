@@ -0,0 +1,197 @@
+// +build linux
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// batchConn reads and writes several packets per syscall by recvmmsg and sendmmsg.
+// ipv4.Message and ipv6.Message are the same type.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn wraps a UDP socket. Return nil if conn is not a UDP socket.
+func newBatchConn(conn net.PacketConn) batchConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if localAddr := udpConn.LocalAddr().(*net.UDPAddr); localAddr.IP.To4() != nil {
+		return ipv4.NewPacketConn(udpConn)
+	}
+	return ipv6.NewPacketConn(udpConn)
+}
+
+// listenReusePort opens n sockets on the same port with SO_REUSEPORT, the kernel spreads peers among them.
+func listenReusePort(port, n int) ([]net.PacketConn, error) {
+	config := net.ListenConfig{Control: func(network, address string, conn syscall.RawConn) error {
+		var sockErr error
+		err := conn.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	network, host := "udp", "[::]"
+	conns := make([]net.PacketConn, 0, n)
+	for len(conns) < n {
+		conn, err := config.ListenPacket(context.Background(), network, fmt.Sprintf(`%s:%d`, host, port))
+		if err != nil && len(conns) == 0 && network == "udp" {
+			// IPv6 is unavailable.
+			network, host = "udp4", ""
+			continue
+		}
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		// A random port is decided by the first socket.
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// readLoop reads packets from a socket in batches until the server stops.
+func (server *Server) readLoop(conn net.PacketConn) {
+	batch := newBatchConn(conn)
+	if batch == nil || server.config.BatchSize <= 1 {
+		server.readLoopSingle(conn)
+		return
+	}
+	messages := make([]ipv4.Message, server.config.BatchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{GetBuffer()}
+	}
+	defer func() {
+		for i := range messages {
+			PutBuffer(messages[i].Buffers[0])
+		}
+	}()
+	for {
+		n, err := batch.ReadBatch(messages, 0)
+		if err != nil {
+			if server.stopping() {
+				return // STOP
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			server.handlePacket(conn, messages[i].Buffers[0], messages[i].N, messages[i].Addr)
+			messages[i].Buffers[0] = GetBuffer()
+		}
+	}
+}
+
+// batchWriter queues outgoing packets and writes them in batches.
+type batchWriter struct {
+	conn  batchConn
+	queue chan batchPacket
+	stop  chan struct{} // Closed by close.
+	done  chan struct{} // Closed once run exits.
+}
+
+// batchPacket is a queued packet. failed is called if it could not be written, unless nil.
+type batchPacket struct {
+	message ipv4.Message
+	failed  func(error)
+}
+
+// newBatchWriter creates a writer on a socket and starts it. Return nil if batching is unavailable.
+func newBatchWriter(conn net.PacketConn, size int) *batchWriter {
+	batch := newBatchConn(conn)
+	if batch == nil || size <= 1 {
+		return nil
+	}
+	writer := &batchWriter{batch, make(chan batchPacket, size*4), make(chan struct{}), make(chan struct{})}
+	go writer.run(size)
+	return writer
+}
+
+// write queues a copy of bytes. Only UDP addresses could be written in batches.
+// The write error is only known later, and reported to failed if not nil.
+func (writer *batchWriter) write(bytes []byte, addr net.Addr, failed func(error)) bool {
+	if _, ok := addr.(*net.UDPAddr); !ok || len(bytes) > MaxPackageSize {
+		return false
+	}
+	buffer := GetBuffer()
+	select {
+	case writer.queue <- batchPacket{ipv4.Message{Buffers: [][]byte{buffer[:copy(buffer, bytes)]}, Addr: addr}, failed}:
+		return true
+	case <-writer.stop:
+		PutBuffer(buffer)
+		return false
+	}
+}
+
+// close writes what is queued, then stops the writer. Later writes are refused.
+func (writer *batchWriter) close() {
+	if writer == nil {
+		return
+	}
+	close(writer.stop)
+	<-writer.done
+}
+
+// run writes whatever is queued at once, at most size packets per syscall.
+func (writer *batchWriter) run(size int) {
+	defer close(writer.done)
+	messages := make([]ipv4.Message, 0, size)
+	failed := make([]func(error), 0, size)
+	for {
+		var packet batchPacket
+		select {
+		case packet = <-writer.queue:
+		case <-writer.stop:
+			// Flush what is left.
+			select {
+			case packet = <-writer.queue:
+			default:
+				return
+			}
+		}
+		messages, failed = append(messages[:0], packet.message), append(failed[:0], packet.failed)
+	collect:
+		for len(messages) < size {
+			select {
+			case packet := <-writer.queue:
+				messages, failed = append(messages, packet.message), append(failed, packet.failed)
+			default:
+				break collect
+			}
+		}
+		for sent := 0; sent < len(messages); {
+			n, err := writer.conn.WriteBatch(messages[sent:], 0)
+			if n > 0 {
+				sent += n
+			}
+			if err != nil {
+				// The packet at sent failed, the rest are tried again.
+				log.Printf("failed to write a packet to %s: %s\n", messages[sent].Addr, err)
+				if failed[sent] != nil {
+					failed[sent](err)
+				}
+				sent++
+			}
+		}
+		for i := range messages {
+			PutBuffer(messages[i].Buffers[0])
+			messages[i], failed[i] = ipv4.Message{}, nil
+		}
+	}
+}
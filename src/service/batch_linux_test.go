@@ -0,0 +1,117 @@
+// +build linux
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+// listenLoopback opens a socket on loopback which is closed once the test ends.
+func listenLoopback(tb testing.TB) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// drain reads from conn until it is closed, so that the receive buffer never fills.
+func drain(conn net.PacketConn) {
+	buffer := make([]byte, MaxPackageSize)
+	for {
+		if _, _, err := conn.ReadFrom(buffer); err != nil {
+			return
+		}
+	}
+}
+
+func TestBatchWriterReportsFailure(t *testing.T) {
+	writer := newBatchWriter(listenLoopback(t), 4)
+	failures := make(chan error, 1)
+	// An IPv4 socket cannot write to an IPv6 address.
+	if !writer.write([]byte("rumor"), &net.UDPAddr{IP: net.IPv6loopback, Port: 54321}, func(err error) { failures <- err }) {
+		t.Fatal("write is not queued")
+	}
+	writer.close()
+	select {
+	case <-failures:
+	default:
+		t.Fatal("failure is not reported")
+	}
+}
+
+func BenchmarkLoopbackWrite(b *testing.B) {
+	packet := make([]byte, 512)
+	for _, batchSize := range []int{1, 32} {
+		b.Run(map[int]string{1: "single", 32: "batched"}[batchSize], func(b *testing.B) {
+			receiver := listenLoopback(b)
+			go drain(receiver)
+			conn := listenLoopback(b)
+			writer := newBatchWriter(conn, batchSize)
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if writer == nil || !writer.write(packet, receiver.LocalAddr(), nil) {
+					conn.WriteTo(packet, receiver.LocalAddr())
+				}
+			}
+			writer.close()
+		})
+	}
+}
+
+func BenchmarkLoopbackRead(b *testing.B) {
+	packet := make([]byte, 512)
+	for _, batchSize := range []int{1, 32} {
+		b.Run(map[int]string{1: "single", 32: "batched"}[batchSize], func(b *testing.B) {
+			conn := listenLoopback(b)
+			sender := listenLoopback(b)
+			stop, stopped := make(chan struct{}), make(chan struct{})
+			defer func() {
+				close(stop)
+				<-stopped
+			}()
+			// Lost packets are made up by sending until the reader is done.
+			go func() {
+				defer close(stopped)
+				writer := newBatchWriter(sender, 32)
+				defer writer.close()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						writer.write(packet, conn.LocalAddr(), nil)
+					}
+				}
+			}()
+			batch := newBatchConn(conn)
+			messages := make([]ipv4.Message, batchSize)
+			for i := range messages {
+				messages[i].Buffers = [][]byte{make([]byte, MaxPackageSize)}
+			}
+			b.SetBytes(int64(len(packet)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for read := 0; read < b.N; {
+				if batchSize == 1 {
+					if _, _, err := conn.ReadFrom(messages[0].Buffers[0]); err != nil {
+						b.Fatal(err)
+					}
+					read++
+					continue
+				}
+				n, err := batch.ReadBatch(messages, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				read += n
+			}
+		})
+	}
+}
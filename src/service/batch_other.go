@@ -0,0 +1,32 @@
+// +build !linux
+
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is only supported on Linux.
+func listenReusePort(port, n int) ([]net.PacketConn, error) {
+	return nil, errors.New("SO_REUSEPORT readers are only supported on Linux")
+}
+
+// readLoop reads packets one by one, since batched reading is only supported on Linux.
+func (server *Server) readLoop(conn net.PacketConn) {
+	server.readLoopSingle(conn)
+}
+
+// batchWriter is only available on Linux.
+type batchWriter struct{}
+
+// newBatchWriter returns nil, since batched writing is only supported on Linux.
+func newBatchWriter(conn net.PacketConn, size int) *batchWriter {
+	return nil
+}
+
+func (writer *batchWriter) write(bytes []byte, addr net.Addr, failed func(error)) bool {
+	return false
+}
+
+func (writer *batchWriter) close() {}
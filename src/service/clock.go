@@ -0,0 +1,159 @@
+package service
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock tells time and runs functions later. SystemClock is used unless another one is injected,
+// e.g. a FakeClock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function scheduled by a Clock. *time.Timer is one.
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// after is time.After by a Clock. The channel is closed once d has passed, stop the timer if it is no longer waited for.
+func after(clock Clock, d time.Duration) (<-chan struct{}, Timer) {
+	elapsed := make(chan struct{})
+	return elapsed, clock.AfterFunc(d, func() {
+		close(elapsed)
+	})
+}
+
+// FakeClock is a Clock whose time only moves on Advance, so that timeouts and expiry are driven by hand in tests
+// and simulations without costing real time.
+type FakeClock struct {
+	now    time.Time
+	timers timerHeap
+	seq    uint64 // Orders timers due at the same time.
+	lock   sync.Mutex
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	seq   uint64
+	f     func()
+	index int // Index in the heap, -1 once fired or stopped.
+}
+
+// NewFakeClock creates a fake clock starting at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the virtual time.
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+// AfterFunc schedules f at d after the virtual now. f is run by Advance.
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.seq++
+	timer := &fakeTimer{clock: clock, when: clock.now.Add(d), seq: clock.seq, f: f}
+	heap.Push(&clock.timers, timer)
+	return timer
+}
+
+// Advance moves time forward by d, running due functions in order. Functions scheduled by them for no later
+// than the new time run as well.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	end := clock.now.Add(d)
+	for len(clock.timers) > 0 && !clock.timers[0].when.After(end) {
+		timer := heap.Pop(&clock.timers).(*fakeTimer)
+		if timer.when.After(clock.now) {
+			clock.now = timer.when
+		}
+		clock.lock.Unlock()
+		timer.f()
+		clock.lock.Lock()
+	}
+	clock.now = end
+	clock.lock.Unlock()
+}
+
+// Next returns when the earliest scheduled function is due. Return false if nothing is scheduled.
+func (clock *FakeClock) Next() (time.Time, bool) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	if len(clock.timers) == 0 {
+		return time.Time{}, false
+	}
+	return clock.timers[0].when, true
+}
+
+// Pending returns the number of scheduled functions.
+func (clock *FakeClock) Pending() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.timers)
+}
+
+// Stop cancels the function. Return false if it has run or been stopped.
+func (timer *fakeTimer) Stop() bool {
+	timer.clock.lock.Lock()
+	defer timer.clock.lock.Unlock()
+	if timer.index < 0 {
+		return false
+	}
+	heap.Remove(&timer.clock.timers, timer.index)
+	return true
+}
+
+// timerHeap orders timers by due time, implementing heap.Interface.
+type timerHeap []*fakeTimer
+
+func (h timerHeap) Len() int {
+	return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	timer := x.(*fakeTimer)
+	timer.index = len(*h)
+	*h = append(*h, timer)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	timer := old[len(old)-1]
+	old[len(old)-1] = nil
+	timer.index = -1
+	*h = old[:len(old)-1]
+	return timer
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+/*
+Payload codec:
+A payload is a sequence of fields, each of which is
+| Tag 1 | Value length, uvarint | Value |
+Tags are defined per message type from 1, and those from 0xF0 are shared by all types, e.g. tagObserved.
+Shared fields are taken by the decoder itself, so that a payload is decoded in one walk.
+A tag is never reused for another meaning. Fields added by newer versions get new tags, and decoders skip
+tags they do not know, so that older nodes keep working with newer ones. A field which older nodes must not
+ignore needs a new message type instead.
+Values are raw bytes, uvarints, NodeIDs, UDP addresses dumped by DumpUDPAddr, or contacts dumped by Node.Dumps.
+Repeated tags make lists.
+*/
+
+// Tags shared by all message types.
+const (
+	tagObserved byte = 0xF0 // Requester's address observed by the responder, see DataObserved.
+)
+
+// FieldSize returns the encoded size of a field whose value is n bytes, for size accounting against
+// MaxPayloadSize.
+func FieldSize(n int) int {
+	var length [binary.MaxVarintLen64]byte
+	return 1 + binary.PutUvarint(length[:], uint64(n)) + n
+}
+
+// Encoder encodes fields of a payload.
+type Encoder struct {
+	buffer []byte
+}
+
+// NewEncoder creates an empty encoder.
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// Bytes appends a field of raw bytes.
+func (encoder *Encoder) Bytes(tag byte, value []byte) {
+	var length [binary.MaxVarintLen64]byte
+	encoder.buffer = append(encoder.buffer, tag)
+	encoder.buffer = append(encoder.buffer, length[:binary.PutUvarint(length[:], uint64(len(value)))]...)
+	encoder.buffer = append(encoder.buffer, value...)
+}
+
+// Uint appends a field of an unsigned integer.
+func (encoder *Encoder) Uint(tag byte, value uint64) {
+	var bytes [binary.MaxVarintLen64]byte
+	encoder.Bytes(tag, bytes[:binary.PutUvarint(bytes[:], value)])
+}
+
+// ID appends a field of a NodeID.
+func (encoder *Encoder) ID(tag byte, id *NodeID) {
+	encoder.Bytes(tag, id[:])
+}
+
+// Addr appends a field of a UDP address. Return false if the address cannot be dumped.
+func (encoder *Encoder) Addr(tag byte, addr *net.UDPAddr) bool {
+	bytes := DumpUDPAddr(addr)
+	if bytes == nil {
+		return false
+	}
+	encoder.Bytes(tag, bytes)
+	return true
+}
+
+// Contact appends a field of a contact. Return false if the contact cannot be dumped.
+func (encoder *Encoder) Contact(tag byte, node *Node) bool {
+	bytes := node.Dumps()
+	if bytes == nil {
+		return false
+	}
+	encoder.Bytes(tag, bytes)
+	return true
+}
+
+// Len returns the encoded size.
+func (encoder *Encoder) Len() int {
+	return len(encoder.buffer)
+}
+
+// Dump returns the encoded payload.
+func (encoder *Encoder) Dump() []byte {
+	return encoder.buffer
+}
+
+// Decoder walks through fields of a payload. Values refer to the payload without copying.
+// A malformed field stops the walk, see Err.
+type Decoder struct {
+	bytes    []byte
+	tag      byte
+	value    []byte
+	observed *net.UDPAddr
+	err      error
+}
+
+// NewDecoder creates a decoder of a payload.
+func NewDecoder(bytes []byte) *Decoder {
+	return &Decoder{bytes: bytes}
+}
+
+// Next moves to the next field, skipping shared ones. Return false at the end or once an error occurs.
+func (decoder *Decoder) Next() bool {
+	for decoder.err == nil && len(decoder.bytes) > 0 {
+		length, n := binary.Uvarint(decoder.bytes[1:])
+		if n <= 0 || length > uint64(len(decoder.bytes)-1-n) {
+			decoder.err = datagramError("field", ErrTruncated)
+			return false
+		}
+		decoder.tag = decoder.bytes[0]
+		decoder.value = decoder.bytes[1+n : 1+n+int(length)]
+		decoder.bytes = decoder.bytes[1+n+int(length):]
+		if decoder.tag != tagObserved {
+			return true
+		}
+		decoder.observed = decoder.Addr()
+	}
+	return false
+}
+
+// Tag returns the tag of the current field.
+func (decoder *Decoder) Tag() byte {
+	return decoder.tag
+}
+
+// Bytes returns the current value as raw bytes.
+func (decoder *Decoder) Bytes() []byte {
+	return decoder.value
+}
+
+// Uint returns the current value as an unsigned integer no more than max.
+func (decoder *Decoder) Uint(max uint64) uint64 {
+	value, n := binary.Uvarint(decoder.value)
+	if n <= 0 || n != len(decoder.value) || value > max {
+		decoder.illegal()
+		return 0
+	}
+	return value
+}
+
+// ID returns the current value as a NodeID.
+func (decoder *Decoder) ID() *NodeID {
+	if len(decoder.value) != NodeIDLength {
+		decoder.illegal()
+		return nil
+	}
+	id := new(NodeID)
+	copy(id[:], decoder.value)
+	return id
+}
+
+// Addr returns the current value as a UDP address.
+func (decoder *Decoder) Addr() *net.UDPAddr {
+	addr := LoadUDPAddr(decoder.value)
+	if addr == nil {
+		decoder.illegal()
+	}
+	return addr
+}
+
+// Contact returns the current value as a contact.
+func (decoder *Decoder) Contact() *Node {
+	node := new(Node)
+	if n, err := node.Loads(decoder.value); err != nil || n != len(decoder.value) {
+		decoder.illegal()
+		return nil
+	}
+	return node
+}
+
+// Observed returns the observed address walked through so far, nil if none.
+func (decoder *Decoder) Observed() *net.UDPAddr {
+	return decoder.observed
+}
+
+// Err returns the error which stopped the walk, nil if none.
+func (decoder *Decoder) Err() error {
+	return decoder.err
+}
+
+func (decoder *Decoder) illegal() {
+	if decoder.err == nil {
+		decoder.err = datagramError(fmt.Sprintf("field %d", decoder.tag), ErrIllegal)
+	}
+}
+
+// missing returns the error of a required field which is absent.
+func missing(field string) error {
+	return datagramError(field, ErrMissing)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+/*
+Compression:
+A payload is sent DEFLATE compressed if the Compressed flag of the header is set. Every datagram of a node with
+compression enabled carries the AcceptsCompressed flag, and a response is compressed only if its request carried
+it, so that nodes with compression disabled are never sent what they refuse. Requests are never compressed.
+Compressed requests, and compressed packets to a node with compression disabled, are rejected as malformed before
+anything is inflated.
+A payload is compressed only when it is at least compressThreshold bytes and compressing saves bytes. Once
+compressed, a payload may exceed MaxPayloadSize as long as the datagram fits in MaxPackageSize.
+Inflating stops at MaxInflatedSize, so that a small packet cannot make a node allocate much.
+*/
+
+// compressThreshold is the smallest payload worth compressing.
+const compressThreshold = 128
+
+// MaxInflatedSize bounds the size of a payload, compressed or not.
+const MaxInflatedSize = 16 * MaxPackageSize
+
+var flateWriterPool = sync.Pool{New: func() interface{} {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return writer
+}}
+
+var flateReaderPool = sync.Pool{New: func() interface{} {
+	return flate.NewReader(nil)
+}}
+
+// checkCompressed rejects a compressed packet unless local node accepts compressed payloads.
+func checkCompressed(packet []byte, accepts bool) error {
+	if !accepts && len(packet) > 0 && packet[0]&Compressed == Compressed {
+		return datagramError("compressed flag", ErrIllegal)
+	}
+	return nil
+}
+
+// deflate compresses bytes. Return nil if that saves nothing.
+func deflate(payload []byte) []byte {
+	var buffer bytes.Buffer
+	writer := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(writer)
+	writer.Reset(&buffer)
+	if _, err := writer.Write(payload); err != nil || writer.Close() != nil || buffer.Len() >= len(payload) {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// inflate decompresses bytes into dst, which is reused if large enough. At most MaxInflatedSize bytes are inflated.
+func inflate(dst, compressed []byte) ([]byte, error) {
+	reader := flateReaderPool.Get().(io.ReadCloser)
+	defer flateReaderPool.Put(reader)
+	if err := reader.(flate.Resetter).Reset(bytes.NewReader(compressed), nil); err != nil {
+		return nil, datagramError("compressed payload", ErrEncoding)
+	}
+	buffer := bytes.NewBuffer(dst[:0])
+	n, err := buffer.ReadFrom(io.LimitReader(reader, int64(MaxInflatedSize)+1))
+	if err != nil {
+		return nil, datagramError("compressed payload", ErrEncoding)
+	}
+	if n > int64(MaxInflatedSize) {
+		return nil, datagramError("compressed payload", ErrTooLarge)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Compress makes the payload go compressed if that saves bytes. Return whether it does.
+func (datagram *Datagram) Compress() bool {
+	if len(datagram.Payload) < compressThreshold {
+		return false
+	}
+	deflated := deflate(datagram.Payload)
+	if deflated == nil {
+		return false
+	}
+	datagram.Compressed, datagram.deflated = true, deflated
+	return true
+}
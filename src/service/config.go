@@ -1,11 +1,16 @@
 package service
 
-// K sets K-bucket size
-const K int = 8
-
-// Port set the port used for listening
-// Note: This option only defines local listen port. For terminals behind NAT(s), it will differ from local node's address.
-const Port int = 54321
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // NodeIDLength sets NodeID length in bytes. Default 20 in SHA-1.
 const NodeIDLength int = 20
@@ -19,14 +24,290 @@ const MaxTextLength int = 200
 // MaxPackageSize sets Max UDP package size in bytes. Default 1460, considering PPPOE.
 const MaxPackageSize int = 1460
 
-// RequestTimeout sets Timeout of every request in seconds. Note: This is the least time a cookie would be preserved.
-const RequestTimeout float64 = 60
+// EnvPrefix is the prefix of environment variables overriding config, e.g. RUMOR_PORT.
+const EnvPrefix = "RUMOR_"
+
+// Config holds runtime options. Durations are in seconds unless noted.
+// It is loaded from a JSON file, then overridden by environment variables and command line flags.
+type Config struct {
+	// K sets K-bucket size
+	K int `json:"k"`
+	// Port set the port used for listening
+	// Note: This option only defines local listen port. For terminals behind NAT(s), it will differ from local node's address.
+	Port int `json:"port"`
+	// RequestTimeout sets Timeout of every request.
+	RequestTimeout float64 `json:"request_timeout"`
+	// LookupParallelism sets how many nodes are asked at once in a node lookup, known as alpha in Kademlia.
+	LookupParallelism int `json:"lookup_parallelism"`
+	// ShutdownTimeout sets how long the daemon waits for in-flight work on stop.
+	ShutdownTimeout float64 `json:"shutdown_timeout"`
+	// StatelessCookies makes requests whose responses need no channel, e.g. eviction pings, carry cookies verified
+	// without state, see CookieSigner. The CookieTable then only grows with requests made by local node itself.
+	StatelessCookies bool `json:"stateless_cookies"`
+	// Compression compresses large responses to requesters accepting it, and makes local node accept compressed
+	// responses, see compress.go.
+	Compression bool `json:"compression"`
+	// Readers sets the number of sockets sharing the port by SO_REUSEPORT, each of which has a reader. Linux only.
+	Readers int `json:"readers"`
+	// BatchSize sets how many packets are read or written per syscall by recvmmsg and sendmmsg. Linux only, 1 disables batching.
+	BatchSize int `json:"batch_size"`
+	// ResponseWorkers sets the number of response handlers.
+	ResponseWorkers int `json:"response_workers"`
+	// RequestWorkers sets the number of request handlers, as well as of hole punching and node welcoming handlers.
+	RequestWorkers int `json:"request_workers"`
+	// RelayWorkers sets the number of relay forwarding handlers.
+	RelayWorkers int `json:"relay_workers"`
+	// ResponseHandlerQueueLength sets Response handler queue length. Responses are dropped once it is full.
+	ResponseHandlerQueueLength int `json:"response_handler_queue_length"`
+	// RequestHandlerQueueLength sets the queue length of every request traffic class. Requests are dropped once it is full.
+	RequestHandlerQueueLength int `json:"request_handler_queue_length"`
+
+	// STUNServers sets STUN servers used for detecting public address. They are tried in order.
+	STUNServers []string `json:"stun_servers"`
+	// STUNTimeout sets Timeout of querying one STUN server.
+	STUNTimeout float64 `json:"stun_timeout"`
+	// NetworkCheckInterval sets Frequency of checking local network changes.
+	// Public address and NAT type will be detected again once a change is found.
+	NetworkCheckInterval int `json:"network_check_interval"`
+
+	// PunchAttempts sets how many punch packets are sent to a peer during hole punching.
+	PunchAttempts int `json:"punch_attempts"`
+	// PunchInterval sets Interval between punch packets in milliseconds.
+	PunchInterval int `json:"punch_interval"`
+	// PunchTimeout sets Timeout of the whole hole punching, including rendezvous.
+	PunchTimeout float64 `json:"punch_timeout"`
+	// SignalTimeout sets Timeout of XMPP login and of waiting for an answer to an offer.
+	// Offers older than it are regarded as replays.
+	SignalTimeout float64 `json:"signal_timeout"`
+
+	// RelayMaxSessions sets the max number of relay slots a relay node offers.
+	RelayMaxSessions int `json:"relay_max_sessions"`
+	// RelayBandwidth sets Max relayed bandwidth of every session in bytes per second.
+	RelayBandwidth int `json:"relay_bandwidth"`
+	// RelaySessionLifetime sets how long a relay reservation lasts without refreshing.
+	RelaySessionLifetime int `json:"relay_session_lifetime"`
+	// RelayRefreshInterval sets Frequency of refreshing relay reservations.
+	// It also keeps NAT bindings towards the relay alive, so it should be shorter than common binding timeout.
+	RelayRefreshInterval int `json:"relay_refresh_interval"`
+
+	// PortMapping enables mapping the listening port on the gateway.
+	PortMapping bool `json:"port_mapping"`
+	// PortMappingLifetime sets the lifetime requested for gateway port mappings.
+	// Mappings are renewed at half of the granted lifetime.
+	PortMappingLifetime int `json:"port_mapping_lifetime"`
+	// PortMappingTimeout sets Timeout of every port mapping request.
+	PortMappingTimeout float64 `json:"port_mapping_timeout"`
+
+	// KeepaliveContacts sets how many contacts keepalives are sent to.
+	KeepaliveContacts int `json:"keepalive_contacts"`
+	// KeepaliveMinLifetime sets the NAT binding lifetime assumed before learning.
+	// Mobile carriers may expire bindings within 30 seconds.
+	KeepaliveMinLifetime int `json:"keepalive_min_lifetime"`
+	// KeepaliveMaxProbe sets the longest delay of binding lifetime probes.
+	KeepaliveMaxProbe int `json:"keepalive_max_probe"`
+	// KeepaliveProbePrecision sets the precision of learned binding lifetime, probing stops once reached.
+	KeepaliveProbePrecision int `json:"keepalive_probe_precision"`
+	// KeepalivePublicInterval sets Keepalive interval on a public address.
+	KeepalivePublicInterval int `json:"keepalive_public_interval"`
+
+	// ObservationQuorum sets how many independent peers must agree on local node's observed address before adopting it.
+	ObservationQuorum int `json:"observation_quorum"`
+	// ObservationLifetime sets how long an observed address reported by a peer is kept.
+	ObservationLifetime int `json:"observation_lifetime"`
+}
+
+// DefaultConfig returns the default config.
+func DefaultConfig() *Config {
+	return &Config{
+		K:                          8,
+		Port:                       54321,
+		RequestTimeout:             60,
+		LookupParallelism:          3,
+		ShutdownTimeout:            10,
+		StatelessCookies:           false,
+		Compression:                true,
+		Readers:                    1,
+		BatchSize:                  32,
+		ResponseWorkers:            2,
+		RequestWorkers:             8,
+		RelayWorkers:               4,
+		ResponseHandlerQueueLength: 256,
+		RequestHandlerQueueLength:  256,
+
+		STUNServers:          []string{"stun.l.google.com:19302", "stun1.l.google.com:19302", "stun.stunprotocol.org:3478"},
+		STUNTimeout:          3,
+		NetworkCheckInterval: 10,
+
+		PunchAttempts: 5,
+		PunchInterval: 200,
+		PunchTimeout:  5,
+		SignalTimeout: 15,
+
+		RelayMaxSessions:     32,
+		RelayBandwidth:       32 * 1024,
+		RelaySessionLifetime: 120,
+		RelayRefreshInterval: 20,
+
+		PortMapping:         true,
+		PortMappingLifetime: 7200,
+		PortMappingTimeout:  3,
+
+		KeepaliveContacts:       2,
+		KeepaliveMinLifetime:    20,
+		KeepaliveMaxProbe:       180,
+		KeepaliveProbePrecision: 5,
+		KeepalivePublicInterval: 300,
+
+		ObservationQuorum:   3,
+		ObservationLifetime: 600,
+	}
+}
+
+// retiredConfigKeys are keys no longer used, which are ignored so that config files of older homes still load.
+var retiredConfigKeys = []string{
+	"refresh_internal", // Cookies expire on their own timers.
+}
+
+// LoadConfig loads a JSON config file over the default config. Missing keys keep their default values,
+// unknown keys are rejected except retired ones.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("illegal config file %s: %s", path, err)
+	}
+	for _, key := range retiredConfigKeys {
+		delete(fields, key)
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("illegal config file %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// ApplyEnv overrides config by environment variables named EnvPrefix + upper case key, e.g. RUMOR_REQUEST_TIMEOUT.
+func (cfg *Config) ApplyEnv() error {
+	for _, key := range cfg.Keys() {
+		if value, isExist := os.LookupEnv(EnvPrefix + strings.ToUpper(key)); isExist {
+			if err := cfg.Set(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Keys returns all config keys in definition order.
+func (cfg *Config) Keys() []string {
+	configType := reflect.TypeOf(*cfg)
+	keys := make([]string, configType.NumField())
+	for i := range keys {
+		keys[i] = configType.Field(i).Tag.Get("json")
+	}
+	return keys
+}
 
-// RefreshInternal sets Frequency of CookieTable Refresh. It's an interval in seconds.
-const RefreshInternal int = 30
+// Set sets an option by its key from a string. Lists are separated by commas.
+func (cfg *Config) Set(key, value string) error {
+	configValue := reflect.ValueOf(cfg).Elem()
+	configType := configValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		if configType.Field(i).Tag.Get("json") != key {
+			continue
+		}
+		field := configValue.Field(i)
+		var err error
+		switch field.Kind() {
+		case reflect.Int:
+			var v int
+			if v, err = strconv.Atoi(value); err == nil {
+				field.SetInt(int64(v))
+			}
+		case reflect.Float64:
+			var v float64
+			if v, err = strconv.ParseFloat(value, 64); err == nil {
+				field.SetFloat(v)
+			}
+		case reflect.Bool:
+			var v bool
+			if v, err = strconv.ParseBool(value); err == nil {
+				field.SetBool(v)
+			}
+		case reflect.Slice:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		}
+		if err != nil {
+			return fmt.Errorf("illegal value of %s: %s", key, value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key %s", key)
+}
 
-// ResponseHandlerQueueLength sets Response handler queue length
-const ResponseHandlerQueueLength int = 16
+// Validate checks the config for values that cannot work.
+func (cfg *Config) Validate() error {
+	positives := map[string]float64{
+		"k":                             float64(cfg.K),
+		"request_timeout":               cfg.RequestTimeout,
+		"lookup_parallelism":            float64(cfg.LookupParallelism),
+		"readers":                       float64(cfg.Readers),
+		"batch_size":                    float64(cfg.BatchSize),
+		"response_workers":              float64(cfg.ResponseWorkers),
+		"request_workers":               float64(cfg.RequestWorkers),
+		"relay_workers":                 float64(cfg.RelayWorkers),
+		"response_handler_queue_length": float64(cfg.ResponseHandlerQueueLength),
+		"request_handler_queue_length":  float64(cfg.RequestHandlerQueueLength),
+		"stun_timeout":                  cfg.STUNTimeout,
+		"network_check_interval":        float64(cfg.NetworkCheckInterval),
+		"punch_attempts":                float64(cfg.PunchAttempts),
+		"punch_timeout":                 cfg.PunchTimeout,
+		"signal_timeout":                cfg.SignalTimeout,
+		"shutdown_timeout":              cfg.ShutdownTimeout,
+		"relay_session_lifetime":        float64(cfg.RelaySessionLifetime),
+		"relay_refresh_interval":        float64(cfg.RelayRefreshInterval),
+		"port_mapping_lifetime":         float64(cfg.PortMappingLifetime),
+		"port_mapping_timeout":          cfg.PortMappingTimeout,
+		"keepalive_min_lifetime":        float64(cfg.KeepaliveMinLifetime),
+		"keepalive_public_interval":     float64(cfg.KeepalivePublicInterval),
+		"observation_quorum":            float64(cfg.ObservationQuorum),
+		"observation_lifetime":          float64(cfg.ObservationLifetime),
+	}
+	for _, key := range cfg.Keys() {
+		if value, isExist := positives[key]; isExist && value <= 0 {
+			return fmt.Errorf("%s must be positive", key)
+		}
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return errors.New("port must be in 1-65535")
+	}
+	if cfg.PunchInterval < 0 || cfg.RelayMaxSessions < 0 || cfg.RelayBandwidth < 0 || cfg.KeepaliveContacts < 0 || cfg.KeepaliveProbePrecision < 0 {
+		return errors.New("punch_interval, relay limits and keepalive_contacts must not be negative")
+	}
+	if cfg.KeepaliveMinLifetime > cfg.KeepaliveMaxProbe {
+		return errors.New("keepalive_min_lifetime must not exceed keepalive_max_probe")
+	}
+	if cfg.RelayRefreshInterval >= cfg.RelaySessionLifetime {
+		return errors.New("relay_refresh_interval must be less than relay_session_lifetime")
+	}
+	return nil
+}
 
-// RequestHandlerQueueLength sets Response handler queue length
-const RequestHandlerQueueLength int = 16
+// seconds converts seconds in config to duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
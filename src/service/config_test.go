@@ -0,0 +1,69 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"port": 5000, "request_timeout": 30, "k": 10}`), 0600)
+	t.Setenv(EnvPrefix+"REQUEST_TIMEOUT", "5")
+	t.Setenv(EnvPrefix+"K", "12")
+	t.Setenv(EnvPrefix+"STUN_SERVERS", "a.example:3478, b.example:3478")
+
+	// The file overrides defaults, the environment overrides the file, and flags override the environment.
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Set("k", "16"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 5000 || cfg.RequestTimeout != 5 || cfg.K != 16 || cfg.LookupParallelism != DefaultConfig().LookupParallelism {
+		t.Fatalf("loaded %+v", cfg)
+	}
+	if len(cfg.STUNServers) != 2 || cfg.STUNServers[1] != "b.example:3478" {
+		t.Fatalf("stun servers %q", cfg.STUNServers)
+	}
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigSetRejects(t *testing.T) {
+	cfg := DefaultConfig()
+	for _, pair := range [][2]string{{"k", "many"}, {"request_timeout", "1m"}, {"port_mapping", "perhaps"}, {"no_such_key", "1"}} {
+		if err := cfg.Set(pair[0], pair[1]); err == nil {
+			t.Fatalf("%s=%s is accepted", pair[0], pair[1])
+		}
+	}
+	t.Setenv(EnvPrefix+"K", "many")
+	if err := cfg.ApplyEnv(); err == nil {
+		t.Fatal("illegal environment variable is accepted")
+	}
+}
+
+func TestLoadConfigIgnoresRetiredKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"port": 5000, "request_timeout": 30, "refresh_internal": 30}`), 0600)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 5000 || cfg.RequestTimeout != 30 || cfg.K != DefaultConfig().K {
+		t.Fatalf("loaded %+v", cfg)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"request_timeuot": 30}`), 0600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("misspelled key is accepted")
+	}
+}
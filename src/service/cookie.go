@@ -1,88 +1,178 @@
 package service
 
 import (
-	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
 	"sync"
 	"time"
 )
 
 // Table is an interface for a table.
-// Delete/Remove method has not been considered necessary yet because the table implements a gc mechanism.
+// An entry lives until it is removed or its timeout expires, whichever comes first.
 type Table interface {
 	Get(*Cookie) chan<- *Datagram
-	Add(*Cookie, chan<- *Datagram) *Cookie
+	Add(*Cookie, chan<- *Datagram, time.Duration) *Cookie
+	Remove(*Cookie) chan<- *Datagram
+	Close()
 }
 
-// CookieTable will collect outdated cookie automatically.
+// cookieShards sets the number of CookieTable shards, each of which has its own lock.
+const cookieShards = 16
+
+// CookieTable maps cookies of outgoing requests to their response channels.
+// An entry is removed on the first response, or on its deadline with its channel closed.
+// Cookies are random, thus sharded by their first byte.
 type CookieTable struct {
-	Map   map[Cookie]chan<- *Datagram
-	Queue *list.List // The oldest one at the front and the latest one at the end.
-	Lock  *sync.Mutex
-}
-
-// QueueMember is the member in a CookieTable's Queue.
-type QueueMember struct {
-	ptrCookie *Cookie
-	timestamp time.Time // UTC
-}
-
-// NewCookieTable creates a new cookie table for outgoing requests.
-func NewCookieTable() *CookieTable {
-	ptrCookieTable := &CookieTable{make(map[Cookie]chan<- *Datagram, 25), list.New(), &sync.Mutex{}}
-	go func() {
-		var qMember QueueMember
-		var prev *list.Element
-		var channel chan<- *Datagram
-		var isExist bool
-		for tNow := range time.Tick(time.Duration(RefreshInternal) * time.Second) {
-			tNow = tNow.UTC()
-
-			ptrCookieTable.Lock.Lock()
-			prev = nil
-			for p := ptrCookieTable.Queue.Front(); p != nil; p = p.Next() {
-				// Delete the previous element from the list if exist
-				if prev != nil {
-					ptrCookieTable.Queue.Remove(prev)
-				}
-
-				qMember = p.Value.(QueueMember)
-				if tNow.Sub(qMember.timestamp).Seconds() < RequestTimeout {
-					break
-				}
-				channel, isExist = ptrCookieTable.Map[*qMember.ptrCookie]
-				if isExist {
-					close(channel)
-				}
-				delete(ptrCookieTable.Map, *qMember.ptrCookie)
-				prev = p
-			}
-			ptrCookieTable.Lock.Unlock()
-		}
-	}()
-	return ptrCookieTable
+	shards [cookieShards]cookieShard
+	clock  Clock
+}
+
+type cookieShard struct {
+	entries map[Cookie]*cookieEntry
+	closed  bool
+	lock    sync.Mutex
+}
+
+type cookieEntry struct {
+	channel chan<- *Datagram
+	timer   Timer
 }
 
-// Add cookie to table, timestamp will be created automatically.
-// Return value false means a conflict happens between the cookie and an existing cookie.
-func (table *CookieTable) Add(ptrCookie *Cookie, channel chan<- *Datagram) *Cookie {
-	table.Lock.Lock()
-	defer table.Lock.Unlock()
-	_, isExist := table.Map[*ptrCookie]
-	if isExist {
+// NewCookieTable creates a new cookie table for outgoing requests, whose timeouts are measured by clock.
+func NewCookieTable(clock Clock) *CookieTable {
+	table := &CookieTable{clock: clock}
+	for i := range table.shards {
+		table.shards[i].entries = make(map[Cookie]*cookieEntry)
+	}
+	return table
+}
+
+// shard returns the shard of a cookie.
+func (table *CookieTable) shard(ptrCookie *Cookie) *cookieShard {
+	return &table.shards[int(ptrCookie[0])%cookieShards]
+}
+
+// Add cookie to table, which expires after timeout.
+// Return value nil means a conflict happens between the cookie and an existing cookie, or the table is closed.
+func (table *CookieTable) Add(ptrCookie *Cookie, channel chan<- *Datagram, timeout time.Duration) *Cookie {
+	shard := table.shard(ptrCookie)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, isExist := shard.entries[*ptrCookie]; isExist || shard.closed {
 		return nil
 	}
-	table.Map[*ptrCookie] = channel
-	table.Queue.PushBack(QueueMember{ptrCookie, time.Now()})
+	cookie := *ptrCookie
+	shard.entries[cookie] = &cookieEntry{channel, table.clock.AfterFunc(timeout, func() {
+		if channel := table.Remove(&cookie); channel != nil {
+			close(channel)
+		}
+	})}
 	return ptrCookie
 }
 
 // Get the target Cookie channel. If not exist, return nil.
 func (table *CookieTable) Get(ptrCookie *Cookie) chan<- *Datagram {
-	table.Lock.Lock()
-	defer table.Lock.Unlock()
-	channel, isExist := table.Map[*ptrCookie]
+	shard := table.shard(ptrCookie)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, isExist := shard.entries[*ptrCookie]
 	if !isExist {
 		return nil
 	}
-	return channel
+	return entry.channel
+}
+
+// Remove a cookie and return its channel, so that at most one response is delivered to the channel.
+// If not exist, return nil.
+func (table *CookieTable) Remove(ptrCookie *Cookie) chan<- *Datagram {
+	shard := table.shard(ptrCookie)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	entry, isExist := shard.entries[*ptrCookie]
+	if !isExist {
+		return nil
+	}
+	entry.timer.Stop()
+	delete(shard.entries, *ptrCookie)
+	return entry.channel
+}
+
+// Close expires all cookies at once, so that nobody waits for responses any more. Nothing could be added afterwards.
+func (table *CookieTable) Close() {
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.lock.Lock()
+		for cookie, entry := range shard.entries {
+			entry.timer.Stop()
+			close(entry.channel)
+			delete(shard.entries, cookie)
+		}
+		shard.closed = true
+		shard.lock.Unlock()
+	}
+}
+
+// Len returns the number of pending cookies.
+func (table *CookieTable) Len() int {
+	n := 0
+	for i := range table.shards {
+		table.shards[i].lock.Lock()
+		n += len(table.shards[i].entries)
+		table.shards[i].lock.Unlock()
+	}
+	return n
+}
+
+// CookieSigner issues cookies which are verified without keeping any state.
+// They are used for requests whose responses need no channel, so that nobody can grow the CookieTable by making
+// local node send requests, e.g. through the eviction path of Bucket.add.
+// | Time slot 4 | HMAC-SHA256(secret, time slot | type | target address) 16 |
+type CookieSigner struct {
+	secret []byte
+	slot   time.Duration
+	clock  Clock
+}
+
+// NewCookieSigner creates a signer with a random secret. A cookie is valid within its time slot and the next one.
+// Time slots are measured by clock. If failed, return nil.
+func NewCookieSigner(slot time.Duration, clock Clock) *CookieSigner {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return nil
+	}
+	return &CookieSigner{secret, slot, clock}
+}
+
+// Sign returns a cookie bound to a message type, a target address and the current time slot.
+func (signer *CookieSigner) Sign(msgType byte, addr net.Addr) *Cookie {
+	var cookie Cookie
+	binary.BigEndian.PutUint32(cookie[:4], uint32(signer.clock.Now().UnixNano()/int64(signer.slot)))
+	copy(cookie[4:], signer.mac(cookie[:4], msgType, addr))
+	return &cookie
+}
+
+// Verify tells whether a cookie was signed for the message type and the address within the last two time slots.
+func (signer *CookieSigner) Verify(cookie *Cookie, msgType byte, addr net.Addr) bool {
+	current := uint32(signer.clock.Now().UnixNano() / int64(signer.slot))
+	slot := binary.BigEndian.Uint32(cookie[:4])
+	if slot != current && slot+1 != current {
+		return false
+	}
+	return hmac.Equal(cookie[4:], signer.mac(cookie[:4], msgType, addr))
+}
+
+// mac computes the truncated HMAC of a cookie.
+func (signer *CookieSigner) mac(slot []byte, msgType byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, signer.secret)
+	mac.Write(slot)
+	mac.Write([]byte{msgType})
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		mac.Write(DumpUDPAddr(udpAddr))
+	} else {
+		mac.Write([]byte(addr.Network() + addr.String()))
+	}
+	return mac.Sum(nil)[:CookieLength-4]
 }
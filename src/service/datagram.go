@@ -3,14 +3,26 @@ package service
 import (
 	"encoding/binary"
 	"net"
-	"time"
 )
 
 // Define request type
 const (
 	Request byte = 0x80 // 0b10000000 used for set flag on Type to distinguish request or response
 
-	Ping byte = iota
+	Ping         byte = iota
+	Connect           // Ask a rendezvous node to introduce a target node, see punch.go.
+	Introduce         // Rendezvous node introduces a requester to the target.
+	RelayReserve      // Reserve a relay slot, see relay.go.
+	RelayData         // Datagram encapsulated for relaying.
+	Probe             // Ask for a delayed response to learn NAT binding lifetime, see keepalive.go.
+	FindNode          // Ask for the closest contacts to a target, see lookup.go.
+)
+
+// Flags of Type besides Request.
+const (
+	Compressed        byte = 0x40 // Payload is compressed, see compress.go.
+	AcceptsCompressed byte = 0x20 // Sender accepts compressed responses.
+	typeMask          byte = 0x1F
 )
 
 // Datagram defines the datagram structure which is used for transmission
@@ -20,85 +32,200 @@ type Datagram struct {
 	MagicCookie *Cookie
 	SourceNode  *Node
 	Timestamp   uint64
-	Payload     []byte
+	Payload     []byte // Always uncompressed.
+	// Data is Payload decoded as Type once loaded, and Observed is the requester's address observed by the
+	// responder of a loaded response, see DataObserved. Their values refer to Payload.
+	Data     Payload
+	Observed *net.UDPAddr
+	// Compressed tells whether the payload goes compressed, AcceptsCompressed whether the sender accepts
+	// compressed responses, see compress.go.
+	Compressed        bool
+	AcceptsCompressed bool
+
+	// Storage of loaded datagrams, so that loading allocates nothing, see pool.go.
+	cookie   Cookie
+	id       NodeID
+	node     Node
+	payload  []byte
+	buffer   []byte // Owned buffer, put back on Release.
+	deflated []byte // Compressed payload to be sent.
 }
 
-// Payload defines different protocols' payload
+// HeaderLength is the size of a datagram without payload, MaxPayloadSize is what is left for the payload.
+const (
+	HeaderLength   = 1 + CookieLength + NodeIDLength + 8
+	MaxPayloadSize = MaxPackageSize - HeaderLength
+)
+
+// Payload defines different protocols' payload, which is encoded as fields, see codec.go.
 type Payload interface {
-	Dump() []byte
+	Encode(encoder *Encoder)
+	// Decode decodes a request or response payload, checking that required fields are present.
+	Decode(decoder *Decoder, isReq bool) error
 }
 
+// Fields of Ping.
+const (
+	pingNAT byte = iota + 1
+	pingRelaySlots
+)
+
 // DataPing is ping payload
+// A ping request carries the capabilities of its sender, a response carries nothing.
 type DataPing struct {
-	data []byte
+	Caps *Capabilities
 }
 
 // NewPing creates ping payload.
 // Here differs from the paper, ping is not considered to be attached in a RPC reply. However, this could be implemented in the future if necessary.
-func NewPing() *DataPing {
-	return &DataPing{[]byte{}}
+// caps could be nil for a response.
+func NewPing(caps *Capabilities) *DataPing {
+	return &DataPing{caps}
 }
 
-// Dump dumps the payload to byte slice for transmission.
-func (ping *DataPing) Dump() []byte {
-	return ping.data
+// Encode encodes the payload.
+func (ping *DataPing) Encode(encoder *Encoder) {
+	if ping.Caps != nil {
+		encoder.Uint(pingNAT, uint64(ping.Caps.NAT))
+		encoder.Uint(pingRelaySlots, uint64(ping.Caps.RelaySlots))
+	}
+}
+
+// Decode decodes the payload. Caps is nil if the requester advertises nothing.
+func (ping *DataPing) Decode(decoder *Decoder, isReq bool) error {
+	for decoder.Next() {
+		switch decoder.Tag() {
+		case pingNAT:
+			if ping.Caps == nil {
+				ping.Caps = new(Capabilities)
+			}
+			ping.Caps.NAT = NATType(decoder.Uint(0xFF))
+		case pingRelaySlots:
+			if ping.Caps == nil {
+				ping.Caps = new(Capabilities)
+			}
+			ping.Caps.RelaySlots = uint16(decoder.Uint(0xFFFF))
+		}
+	}
+	return decoder.Err()
 }
 
 // NewDatagram creates a datagram.
 // When used for reply, cookie should be passed; otherwise it could be nil to auto-generate.
-func NewDatagram(msgType byte, isReq bool, cookie *Cookie, sourceNode *Node, payload Payload) *Datagram {
+// The timestamp is taken from clock. Return nil if the payload exceeds MaxInflatedSize. A payload exceeding
+// MaxPayloadSize can only be sent compressed, see Compress.
+func NewDatagram(clock Clock, msgType byte, isReq bool, cookie *Cookie, sourceNode *Node, payload Payload) *Datagram {
 	if cookie == nil {
 		cookie = NewRandCookie()
 		if cookie == nil {
 			return nil
 		}
 	}
-	timestamp := uint64(time.Now().UnixNano())
-	payloadBytes := payload.Dump()
-	if (NodeIDLength + CookieLength + len(payloadBytes) + 11) > MaxPackageSize {
+	timestamp := uint64(clock.Now().UnixNano())
+	encoder := NewEncoder()
+	payload.Encode(encoder)
+	if encoder.Len() > MaxInflatedSize {
 		return nil
 	}
-	return &Datagram{msgType, isReq, cookie, sourceNode, timestamp, payloadBytes}
+	return &Datagram{Type: msgType, IsRequest: isReq, MagicCookie: cookie, SourceNode: sourceNode, Timestamp: timestamp, Payload: encoder.Dump()}
+}
+
+// Decode decodes the payload of the datagram into payload. A loaded datagram is decoded already, see Data.
+func (datagram *Datagram) Decode(payload Payload) error {
+	return payload.Decode(NewDecoder(datagram.Payload), datagram.IsRequest)
 }
 
 // Loads loads a datagram from byte slice and net.Addr
 // All sources are a copy of their original ones for detaching from original buffer.
-func (datagram *Datagram) Loads(bytes []byte, addr net.Addr) *Datagram {
-	if len(bytes) < CookieLength+NodeIDLength+9 {
-		return nil
+// The copies are stored in the datagram itself, thus they are valid until the datagram is released or loaded again.
+// A malformed datagram is rejected with a *ParseError, see parse.go.
+func (datagram *Datagram) Loads(bytes []byte, addr net.Addr) error {
+	return datagram.load(bytes, addr, true)
+}
+
+// LoadsView loads a datagram like Loads, except that the payload refers to bytes without copying unless it is
+// compressed. It suits handlers which do not retain the payload.
+func (datagram *Datagram) LoadsView(bytes []byte, addr net.Addr) error {
+	return datagram.load(bytes, addr, false)
+}
+
+// load loads a datagram, copying the payload if detached. The payload is copied before it is decoded into Data,
+// so that Data refers to the copy.
+func (datagram *Datagram) load(bytes []byte, addr net.Addr, detached bool) error {
+	if len(bytes) < HeaderLength {
+		return datagramError("header", ErrTruncated)
 	}
 	p := 0
-	datagram.Type = bytes[p] & ^Request
-	datagram.IsRequest = bytes[p]&Request == Request
+	msgType, isReq := bytes[p]&typeMask, bytes[p]&Request == Request
+	if !validType(msgType) {
+		return datagramError("type", ErrUnknownType)
+	}
+	payload := bytes[HeaderLength:]
+	if bytes[p]&Compressed == Compressed {
+		if isReq {
+			return datagramError("compressed flag", ErrIllegal)
+		}
+		var err error
+		if datagram.payload, err = inflate(datagram.payload, payload); err != nil {
+			return err
+		}
+		payload = datagram.payload
+	} else if detached {
+		datagram.payload = append(datagram.payload[:0], payload...)
+		payload = datagram.payload
+	}
+	data, observed, err := decodePayload(msgType, isReq, payload)
+	if err != nil {
+		return err
+	}
+	datagram.Data, datagram.Observed = data, observed
+
+	datagram.Type, datagram.IsRequest = msgType, isReq
+	datagram.Compressed, datagram.AcceptsCompressed = bytes[p]&Compressed == Compressed, bytes[p]&AcceptsCompressed == AcceptsCompressed
 	p++
-	cookie := new(Cookie)
-	copy((*cookie)[:], bytes[p:p+CookieLength])
-	datagram.MagicCookie = cookie
+	copy(datagram.cookie[:], bytes[p:p+CookieLength])
+	datagram.MagicCookie = &datagram.cookie
 	p += CookieLength
-	id := new(NodeID)
-	copy((*id)[:], bytes[p:p+NodeIDLength])
-	datagram.SourceNode = &Node{id, addr}
+	copy(datagram.id[:], bytes[p:p+NodeIDLength])
+	datagram.node = Node{ID: &datagram.id, Address: addr}
+	datagram.SourceNode = &datagram.node
 	p += NodeIDLength
 	datagram.Timestamp = binary.LittleEndian.Uint64(bytes[p : p+8])
-	p += 8
-	payload := make([]byte, len(bytes)-p)
-	copy(payload, bytes[p:])
 	datagram.Payload = payload
-	return datagram
+	return nil
 }
 
 // Dumps dumps data to []byte for transmission. Parenthesis values are default.
 // |     Type     |    Cookie    | NodeID | Timestamp | Payload |
 // |   1 byte(s)  |      20      |   20   |     8     |   ...   |
+// The highest bits of Type are flags: Request, Compressed and AcceptsCompressed.
 func (datagram *Datagram) Dumps() []byte {
-	totalLength := NodeIDLength + CookieLength + len(datagram.Payload) + 11
-	buffer := make([]byte, totalLength)
+	return datagram.DumpsTo(nil)
+}
+
+// DumpsTo dumps data like Dumps into buffer, which is allocated only if it is too small.
+// The returned slice shares the buffer.
+func (datagram *Datagram) DumpsTo(buffer []byte) []byte {
+	payload := datagram.Payload
+	if datagram.Compressed {
+		payload = datagram.deflated
+	}
+	totalLength := HeaderLength + len(payload)
+	if cap(buffer) < totalLength {
+		buffer = make([]byte, totalLength)
+	}
+	buffer = buffer[:totalLength]
 
 	p := 0
+	buffer[p] = datagram.Type
 	if datagram.IsRequest {
-		buffer[p] = datagram.Type | Request
-	} else {
-		buffer[p] = datagram.Type
+		buffer[p] |= Request
+	}
+	if datagram.Compressed {
+		buffer[p] |= Compressed
+	}
+	if datagram.AcceptsCompressed {
+		buffer[p] |= AcceptsCompressed
 	}
 	p++
 	copy(buffer[p:], (*datagram.MagicCookie)[:])
@@ -107,6 +234,6 @@ func (datagram *Datagram) Dumps() []byte {
 	p += NodeIDLength
 	binary.LittleEndian.PutUint64(buffer[p:], datagram.Timestamp)
 	p += 8
-	copy(buffer[p:], datagram.Payload)
+	copy(buffer[p:], payload)
 	return buffer
 }
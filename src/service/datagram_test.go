@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// newFindNodeResponse returns a FindNode response with K contacts, which is large enough to be compressed.
+// isReq sets the Request flag only, as a peer sending it by mistake would.
+func newFindNodeResponse(source *Node, isReq bool) *Datagram {
+	contacts := make([]*Node, 20)
+	for i := range contacts {
+		id := *source.ID
+		id[NodeIDLength-1] ^= byte(i + 1)
+		contacts[i] = &Node{ID: &id, Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 54321}}
+	}
+	return NewDatagram(SystemClock, FindNode, isReq, nil, source, NewObserved(source.Address, NewFindNode(false, nil, contacts)))
+}
+
+func FuzzDatagramLoads(f *testing.F) {
+	source := &Node{ID: NewRandNodeID(), Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}}
+	f.Add(NewDatagram(SystemClock, Ping, true, nil, source, NewPing(&Capabilities{NAT: NATFullCone})).Dumps())
+	response := newFindNodeResponse(source, false)
+	f.Add(response.Dumps())
+	response.Compress()
+	f.Add(response.Dumps())
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var datagram Datagram
+		if datagram.Loads(packet, source.Address) != nil {
+			return
+		}
+		if datagram.Data == nil {
+			t.Fatal("loaded datagram is not decoded")
+		}
+		// What loads is dumped uncompressed into what loads the same.
+		datagram.Compressed = false
+		var again Datagram
+		if err := again.LoadsView(datagram.Dumps(), source.Address); err != nil {
+			t.Fatalf("dumped datagram does not load: %s", err)
+		}
+		if again.Type != datagram.Type || again.IsRequest != datagram.IsRequest || !bytes.Equal(again.Payload, datagram.Payload) ||
+			again.Observed.String() != datagram.Observed.String() {
+			t.Fatalf("reloaded %+v, want %+v", again, datagram)
+		}
+	})
+}
+
+func TestCompressedPayloadRefused(t *testing.T) {
+	source := &Node{ID: NewRandNodeID(), Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}}
+	compressed := func(isReq bool) []byte {
+		datagram := newFindNodeResponse(source, isReq)
+		if !datagram.Compress() {
+			t.Fatal("payload is not compressed")
+		}
+		return datagram.Dumps()
+	}
+	var datagram Datagram
+	if err := datagram.Loads(compressed(true), source.Address); !errors.Is(err, ErrIllegal) {
+		t.Fatalf("compressed request is loaded: %v", err)
+	}
+
+	for _, accepts := range []bool{true, false} {
+		network := NewMemNetwork(1)
+		conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+		cfg := DefaultConfig()
+		cfg.Compression = accepts
+		server := NewServerOn(NewBucketTree(cfg), cfg, SystemClock, conn)
+		packet := compressed(false)
+		buffer := GetBuffer()
+		server.responses = newWorkerPool("responses", 1, 1, func(datagram *Datagram) { datagram.Release() })
+		server.welcomes = newWorkerPool("welcomes", 1, 1, func(datagram *Datagram) { datagram.Release() })
+		server.handlePacket(conn, buffer, copy(buffer, packet), source.Address)
+		server.responses.stop()
+		server.welcomes.stop()
+		if total, _ := server.Malformed.Stats(); (total == 0) != accepts {
+			t.Fatalf("compression enabled: %t, %d malformed", accepts, total)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Events:
+Changes of the bucket tree and arriving requests are published on Server.Events, so that other parts of a process,
+or external scripts by `rumor events --follow`, could react to them.
+Publishing never blocks: an event is queued for each subscriber, and a subscriber whose queue is full misses it,
+which is counted by Dropped. Events carry copies, thus subscribers may retain them.
+*/
+
+// Event is one of ContactAdded, ContactEvicted, ContactAddressChanged and RequestArrived.
+type Event interface {
+	String() string
+}
+
+// ContactAdded is published when a contact enters a bucket.
+type ContactAdded struct {
+	Node Node
+}
+
+// ContactEvicted is published when a contact is removed from a bucket for not responding.
+type ContactEvicted struct {
+	Node Node
+}
+
+// ContactAddressChanged is published when a contact shows up at another address.
+type ContactAddressChanged struct {
+	Node       Node // With the new address.
+	OldAddress net.Addr
+}
+
+// RequestArrived is published when a well-formed request arrives, before it is handled.
+type RequestArrived struct {
+	Type   byte
+	Source Node
+}
+
+func (event ContactAdded) String() string {
+	return fmt.Sprintf("contact added: %x at %s", *event.Node.ID, event.Node.Address)
+}
+
+func (event ContactEvicted) String() string {
+	return fmt.Sprintf("contact evicted: %x at %s", *event.Node.ID, event.Node.Address)
+}
+
+func (event ContactAddressChanged) String() string {
+	return fmt.Sprintf("contact moved: %x from %s to %s", *event.Node.ID, event.OldAddress, event.Node.Address)
+}
+
+func (event RequestArrived) String() string {
+	return fmt.Sprintf("request arrived: %s from %x at %s", typeName(event.Type), *event.Source.ID, event.Source.Address)
+}
+
+// typeName returns the name of a message type.
+func typeName(msgType byte) string {
+	switch msgType {
+	case Ping:
+		return "ping"
+	case Connect:
+		return "connect"
+	case Introduce:
+		return "introduce"
+	case RelayReserve:
+		return "relay-reserve"
+	case RelayData:
+		return "relay-data"
+	case Probe:
+		return "probe"
+	case FindNode:
+		return "find-node"
+	}
+	return fmt.Sprintf("type %d", msgType)
+}
+
+// EventBus delivers published events to subscribers.
+type EventBus struct {
+	subscribers map[*Subscription]struct{}
+	lock        sync.RWMutex
+}
+
+// Subscription receives events from C until it is closed.
+type Subscription struct {
+	C       <-chan Event
+	events  chan Event
+	dropped uint64
+	bus     *EventBus
+}
+
+// NewEventBus creates a bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe subscribes to all events, queuing at most size of them.
+func (bus *EventBus) Subscribe(size int) *Subscription {
+	events := make(chan Event, size)
+	subscription := &Subscription{C: events, events: events, bus: bus}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	bus.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+// Publish queues an event for every subscriber without blocking. A nil bus drops it.
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	for subscription := range bus.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+// subscribed tells whether anyone subscribes, so that publishers could skip building events.
+func (bus *EventBus) subscribed() bool {
+	if bus == nil {
+		return false
+	}
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	return len(bus.subscribers) > 0
+}
+
+// Dropped returns the number of events missed since the queue was full.
+func (subscription *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&subscription.dropped)
+}
+
+// Close unsubscribes and closes C.
+func (subscription *Subscription) Close() {
+	bus := subscription.bus
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if _, isExist := bus.subscribers[subscription]; isExist {
+		delete(bus.subscribers, subscription)
+		close(subscription.events)
+	}
+}
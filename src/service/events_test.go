@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of subscription, failing if none arrives within a second.
+func nextEvent(t *testing.T, subscription *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-subscription.C:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return nil
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	bus := NewEventBus()
+	if bus.subscribed() {
+		t.Fatal("subscribed without subscribers")
+	}
+	first, second := bus.Subscribe(1), bus.Subscribe(1)
+	event := ContactAdded{Node{ID: NewRandNodeID(), Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}}}
+	bus.Publish(event)
+	for _, subscription := range []*Subscription{first, second} {
+		if got := nextEvent(t, subscription); got.String() != event.String() {
+			t.Fatalf("got %s", got)
+		}
+	}
+
+	// A closed subscription gets nothing more, while others still do. Closing again is harmless.
+	first.Close()
+	first.Close()
+	bus.Publish(event)
+	if _, ok := <-first.C; ok {
+		t.Fatal("event after closing")
+	}
+	if got := nextEvent(t, second); got.String() != event.String() {
+		t.Fatalf("got %s", got)
+	}
+	second.Close()
+	if bus.subscribed() {
+		t.Fatal("subscribed after closing")
+	}
+	var nilBus *EventBus
+	nilBus.Publish(event)
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow, fast := bus.Subscribe(1), bus.Subscribe(10)
+	defer slow.Close()
+	defer fast.Close()
+
+	// Nobody reads the slow subscriber, yet publishing goes on.
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			bus.Publish(RequestArrived{Ping, Node{ID: NewRandNodeID()}})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("publisher blocked by a full subscriber")
+	}
+	if len(slow.C) != 1 || slow.Dropped() != 4 {
+		t.Fatalf("slow subscriber got %d, dropped %d", len(slow.C), slow.Dropped())
+	}
+	if len(fast.C) != 5 || fast.Dropped() != 0 {
+		t.Fatalf("fast subscriber got %d, dropped %d", len(fast.C), fast.Dropped())
+	}
+}
+
+func TestRoutingTableEvents(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.K = 1
+	cfg.StatelessCookies = true
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	cfg.RequestTimeout = 2
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork(1)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	server := NewServerOn(NewBucketTree(cfg), cfg, clock, conn)
+	server.StartService()
+	defer server.Stop(context.Background())
+	events := server.Events.Subscribe(16)
+	defer events.Close()
+
+	// Both fall into bucket 0, which is full with the first one.
+	oldID, newID := *server.KBuckets.Self.ID, *server.KBuckets.Self.ID
+	oldID[0] ^= 0x80
+	newID[0] ^= 0x80
+	newID[NodeIDLength-1] ^= 1
+	oldAddr, movedAddr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 12345}
+	newAddr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 54321}
+
+	server.KBuckets.Add(&oldID, oldAddr)
+	if event, ok := nextEvent(t, events).(ContactAdded); !ok || *event.Node.ID != oldID || !SameAddr(event.Node.Address, oldAddr) {
+		t.Fatalf("got %s, want the contact added", event)
+	}
+	server.KBuckets.Add(&oldID, movedAddr)
+	if event, ok := nextEvent(t, events).(ContactAddressChanged); !ok || !SameAddr(event.Node.Address, movedAddr) || !SameAddr(event.OldAddress, oldAddr) {
+		t.Fatalf("got %s, want the contact moved", event)
+	}
+
+	// The silent contact is evicted for the newcomer.
+	server.KBuckets.Add(&newID, newAddr)
+	clock.Advance(3 * time.Second)
+	server.KBuckets.sweepEvictions()
+	if event, ok := nextEvent(t, events).(ContactEvicted); !ok || *event.Node.ID != oldID {
+		t.Fatalf("got %s, want the contact evicted", event)
+	}
+	if event, ok := nextEvent(t, events).(ContactAdded); !ok || *event.Node.ID != newID {
+		t.Fatalf("got %s, want the newcomer added", event)
+	}
+}
+
+func TestRequestEvents(t *testing.T) {
+	network := NewMemNetwork(1)
+	server := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	peer := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+	events := peer.Events.Subscribe(16)
+	defer events.Close()
+
+	if !server.Ping(peer.KBuckets.SelfNode()) {
+		t.Fatal("peer did not respond")
+	}
+	for {
+		if event, ok := nextEvent(t, events).(RequestArrived); ok {
+			self := server.KBuckets.SelfNode()
+			if event.Type != Ping || *event.Source.ID != *self.ID || !SameAddr(event.Source.Address, self.Address) {
+				t.Fatalf("got %s, want the ping", event)
+			}
+			return
+		}
+	}
+}
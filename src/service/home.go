@@ -0,0 +1,120 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+/*
+Home:
+Every daemon instance owns a home directory, which holds everything that must not be shared between instances
+running on one machine:
+	config.json   Config of the instance, created on first start.
+	identity      | NodeID 20 | ed25519 seed 32 |, the identity used in DHT and for signing offers.
+	tree          Snapshot of the bucket tree.
+	known_keys    Public keys pinned to NodeIDs of signalling peers, see KeyPins.
+	rumor.sock    IPC socket on unix-like systems. On Windows a pipe name is derived from the directory.
+*/
+
+// HomeEnv is the environment variable overriding the default home directory.
+const HomeEnv = "RUMOR_HOME"
+
+// Home is the data directory of a daemon instance.
+type Home struct {
+	Dir string
+}
+
+// DefaultHomeDir returns $RUMOR_HOME, or .rumor under the user's home directory.
+func DefaultHomeDir() string {
+	if dir := os.Getenv(HomeEnv); dir != "" {
+		return dir
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return ".rumor"
+	}
+	return filepath.Join(userHome, ".rumor")
+}
+
+// OpenHome opens a home directory, creating it if not exist.
+func OpenHome(dir string) (*Home, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Home{dir}, nil
+}
+
+// ConfigPath returns the path of the instance config.
+func (home *Home) ConfigPath() string {
+	return filepath.Join(home.Dir, "config.json")
+}
+
+// IdentityPath returns the path of the instance identity.
+func (home *Home) IdentityPath() string {
+	return filepath.Join(home.Dir, "identity")
+}
+
+// StatePath returns the path of the bucket tree snapshot.
+func (home *Home) StatePath() string {
+	return filepath.Join(home.Dir, "tree")
+}
+
+// KeyPinsPath returns the path of the signalling key pins.
+func (home *Home) KeyPinsPath() string {
+	return filepath.Join(home.Dir, "known_keys")
+}
+
+// LoadConfig loads the instance config. On first use a config is created with the default port if it is free,
+// otherwise a random free port, so that instances on one machine never collide.
+func (home *Home) LoadConfig() (*Config, error) {
+	cfg, err := LoadConfig(home.ConfigPath())
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return cfg, err
+	}
+	cfg = DefaultConfig()
+	if conn, err := net.ListenPacket("udp", fmt.Sprintf(`:%d`, cfg.Port)); err == nil {
+		conn.Close()
+	} else if conn, err = net.ListenPacket("udp", ":0"); err == nil {
+		cfg.Port = conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+	} else {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return cfg, os.WriteFile(home.ConfigPath(), data, 0600)
+}
+
+// LoadIdentity loads the NodeID and signing key of the instance, generating new ones on first use.
+func (home *Home) LoadIdentity() (*NodeID, ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(home.IdentityPath())
+	if err == nil {
+		if len(data) != NodeIDLength+ed25519.SeedSize {
+			return nil, nil, errors.New("illegal identity file " + home.IdentityPath())
+		}
+		var id NodeID
+		copy(id[:], data)
+		return &id, ed25519.NewKeyFromSeed(data[NodeIDLength:]), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	id := NewRandNodeID()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = append(append([]byte{}, id[:]...), key.Seed()...)
+	return id, key, os.WriteFile(home.IdentityPath(), data, 0600)
+}
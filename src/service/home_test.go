@@ -0,0 +1,67 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenHome(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a", ".rumor")
+	home, err := OpenHome(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Fatalf("home directory is not created private: %v %v", info, err)
+	}
+	if home.Dir != dir || filepath.Dir(home.StatePath()) != dir {
+		t.Fatalf("home at %s", home.Dir)
+	}
+
+	t.Setenv(HomeEnv, dir)
+	if DefaultHomeDir() != dir {
+		t.Fatalf("%s does not override the home directory", HomeEnv)
+	}
+}
+
+func TestHomeIdentity(t *testing.T) {
+	home, err := OpenHome(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key, err := home.LoadIdentity()
+	if err != nil || id == nil || key == nil {
+		t.Fatalf("identity is not generated: %v", err)
+	}
+	// The same identity is loaded from then on.
+	again, againKey, err := home.LoadIdentity()
+	if err != nil || *again != *id || !againKey.Equal(key) {
+		t.Fatalf("another identity is loaded: %v", err)
+	}
+
+	os.WriteFile(home.IdentityPath(), id[:], 0600)
+	if _, _, err := home.LoadIdentity(); err == nil {
+		t.Fatal("truncated identity is loaded")
+	}
+}
+
+func TestHomeConfig(t *testing.T) {
+	home, err := OpenHome(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := home.LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(home.ConfigPath()); err != nil {
+		t.Fatal("config is not created on first use")
+	}
+	// The port picked on first use is kept.
+	again, err := home.LoadConfig()
+	if err != nil || again.Port != cfg.Port {
+		t.Fatalf("port %d, then %d: %v", cfg.Port, again.Port, err)
+	}
+}
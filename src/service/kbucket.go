@@ -5,58 +5,209 @@ import (
 	"container/list"
 	"encoding/gob"
 	"errors"
-	"log"
 	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
+// Address types stored in a bucket tree snapshot.
+func init() {
+	gob.Register(&net.UDPAddr{})
+	gob.Register(&RelayAddr{})
+	gob.Register(JIDAddr(""))
+}
+
 // BucketTree represents the whole k-bucket tree as it is described in the DHT paper.
 type BucketTree struct {
 	// Self node offers other nodes essential information to contact. The address in it should be a public one.
 	Self     *Node
 	server   *Server
+	config   *Config
 	MaxIndex int // Current max index. The MAX INDEX in theory is NodeIDLength(in bytes) * 8 - 1 .
 	Buckets  [NodeIDLength * 8]*Bucket
+	lock     sync.Mutex // Guards buckets, which handlers access concurrently.
 }
 
-// GetK returns k closest noeds according to a given node.
-// In case there is no enough nodes in the bucket, left-side buckets will be considered.
-// In case all nodes cannot satisfy, all nodes will be returned. The result excludes the given node.
+// GetK returns k closest noeds according to a given node, the closest first.
+// Nodes in the predicted bucket are the closest, followed by nodes in deeper buckets, then by left-side buckets
+// one by one. In case all nodes cannot satisfy, all nodes will be returned. The result excludes the given node.
 func (tree *BucketTree) GetK(id *NodeID) []*Node {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
 	predictedIndex := CommonPrefixLength((*id)[:], (*tree.Self.ID)[:])
 	index := Min(predictedIndex, tree.MaxIndex)
-	result := tree.Buckets[index].getN(K, id)
-	if l := len(result); l < K && index > 0 {
-		leftResult := tree.Buckets[index-1].getN(K-l, id)
-		result = append(result, leftResult...)
+	result := tree.Buckets[index].getN(tree.config.K, id)
+	if len(result) < tree.config.K {
+		// Deeper buckets are equally far from the given node, thus all of them are taken and sorted below.
+		for i := index + 1; i <= tree.MaxIndex; i++ {
+			result = append(result, tree.Buckets[i].getN(tree.config.K, id)...)
+		}
+	}
+	for i := index - 1; i >= 0 && len(result) < tree.config.K; i-- {
+		result = append(result, tree.Buckets[i].getN(tree.config.K-len(result), id)...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return Closer(result[i].ID, result[j].ID, id)
+	})
+	if len(result) > tree.config.K {
+		result = result[:tree.config.K]
 	}
 	return result
 }
 
 // NewBucketTree creates a new empty bucket tree with a new NodeID for itself.
-func NewBucketTree() *BucketTree {
+func NewBucketTree(cfg *Config) *BucketTree {
 	var newTree BucketTree
+	newTree.config = cfg
 
 	var self Node
 	self.ID = NewRandNodeID()
-	addr := DetectPublicAddr()
-	log.Println("Local public Address: ", addr)
-	self.Address = addr
+	// The real public address is detected once the server starts, see Server.DetectPublicAddr.
+	self.Address = &net.UDPAddr{IP: net.IPv4zero, Port: cfg.Port}
 	newTree.Self = &self
 
-	initBucket := Bucket{tree: &newTree, Map: make(map[[NodeIDLength]byte]*list.Element, K), Queue: list.New()}
+	initBucket := Bucket{tree: &newTree, Map: make(map[[NodeIDLength]byte]*list.Element, cfg.K), Queue: list.New()}
 	newTree.Buckets[0] = &initBucket
 	return &newTree
 }
 
+// LoadBucketTree loads a bucket tree saved by Save. The tree uses cfg until a server is set up on it.
+func LoadBucketTree(path string, cfg *Config) (*BucketTree, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tree BucketTree
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&tree); err != nil {
+		return nil, err
+	}
+	tree.config = cfg
+	// Endpoints are advertised again by relays and signallers once the server starts.
+	tree.Self.Endpoints = nil
+	return &tree, nil
+}
+
+// Save writes a snapshot of the tree to path. The old snapshot is replaced only if the new one is complete.
+func (tree *BucketTree) Save(path string) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(tree); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", buffer.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// GobEncode for GobEncoder
+// Only buckets in use are encoded, the rest are nil.
+func (tree *BucketTree) GobEncode() ([]byte, error) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	if err := enc.Encode(tree.Self); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(tree.Buckets[:tree.MaxIndex+1]); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// GobDecode for GobDecoder
+func (tree *BucketTree) GobDecode(data []byte) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	var self Node
+	if err := dec.Decode(&self); err != nil {
+		return err
+	}
+	var buckets []*Bucket
+	if err := dec.Decode(&buckets); err != nil {
+		return err
+	}
+	if self.ID == nil || len(buckets) == 0 || len(buckets) > len(tree.Buckets) {
+		return errors.New("illegal bucket tree")
+	}
+	tree.Self = &self
+	tree.MaxIndex = len(buckets) - 1
+	for i, bucket := range buckets {
+		bucket.Index = i
+		bucket.tree = tree
+		tree.Buckets[i] = bucket
+	}
+	return nil
+}
+
 // SetServerInstance sets the server attribute.
 func (tree *BucketTree) SetServerInstance(server *Server) *Server {
 	tree.server = server
 	return server
 }
 
+// SelfNode returns a copy of local node. Its address and capabilities change while the server runs,
+// thus they are read through here, and written by updateSelf.
+func (tree *BucketTree) SelfNode() *Node {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	self := *tree.Self
+	self.Endpoints = append([]Endpoint(nil), self.Endpoints...)
+	return &self
+}
+
+// updateSelf updates local node under the tree lock.
+func (tree *BucketTree) updateSelf(update func(self *Node)) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	update(tree.Self)
+}
+
+// markResponded records that a contact responded to local node from addr.
+func (tree *BucketTree) markResponded(id *NodeID, addr net.Addr) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	index := Min(CommonPrefixLength((*id)[:], (*tree.Self.ID)[:]), tree.MaxIndex)
+	if ptrElement, isExist := tree.Buckets[index].Map[*id]; isExist {
+		if node := ptrElement.Value.(*Node); SameAddr(node.Address, addr) {
+			node.responded = true
+		}
+	}
+}
+
+// setCapabilities records capabilities advertised by a contact.
+func (tree *BucketTree) setCapabilities(id *NodeID, caps *Capabilities) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	index := Min(CommonPrefixLength((*id)[:], (*tree.Self.ID)[:]), tree.MaxIndex)
+	if ptrElement, isExist := tree.Buckets[index].Map[*id]; isExist {
+		ptrElement.Value.(*Node).Capabilities = *caps
+	}
+}
+
+// hasResponded tells whether a contact has responded to local node from addr.
+func (tree *BucketTree) hasResponded(id *NodeID, addr net.Addr) bool {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	index := Min(CommonPrefixLength((*id)[:], (*tree.Self.ID)[:]), tree.MaxIndex)
+	ptrElement, isExist := tree.Buckets[index].Map[*id]
+	return isExist && ptrElement.Value.(*Node).responded && SameAddr(ptrElement.Value.(*Node).Address, addr)
+}
+
+// respondedContact tells whether a contact has responded to local node at its current address.
+func (tree *BucketTree) respondedContact(id *NodeID) bool {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	ptrElement, isExist := tree.bucket(id).Map[*id]
+	return isExist && ptrElement.Value.(*Node).responded
+}
+
 // Get finds a NodeID's content.
 // If not found, return nil.
 func (tree *BucketTree) Get(id *NodeID) *Node {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
 	predictedIndex := CommonPrefixLength((*id)[:], (*tree.Self.ID)[:])
 	index := Min(predictedIndex, tree.MaxIndex)
 	ptrElement, isExist := tree.Buckets[index].Map[*id]
@@ -66,20 +217,81 @@ func (tree *BucketTree) Get(id *NodeID) *Node {
 	return ptrElement.Value.(*Node)
 }
 
+// BucketNodes returns copies of the nodes in a bucket, the oldest first. Return nil if the bucket does not exist.
+func (tree *BucketTree) BucketNodes(index int) []*Node {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	if index < 0 || index > tree.MaxIndex {
+		return nil
+	}
+	nodes := make([]*Node, 0, len(tree.Buckets[index].Map))
+	for ele := tree.Buckets[index].Queue.Front(); ele != nil; ele = ele.Next() {
+		node := *ele.Value.(*Node)
+		nodes = append(nodes, &node)
+	}
+	return nodes
+}
+
 // Add a Node. If already exist, update its status.
 func (tree *BucketTree) Add(id *NodeID, addr net.Addr) error {
-	predictedIndex := CommonPrefixLength((*id)[:], (*tree.Self.ID)[:])
-	index := Min(predictedIndex, tree.MaxIndex)
-	return tree.Buckets[index].add(&Node{id, addr})
+	return tree.add(&Node{ID: id, Address: addr})
+}
+
+// AddNode adds a node together with its endpoints.
+func (tree *BucketTree) AddNode(node *Node) error {
+	return tree.add(&Node{ID: node.ID, Address: node.Address, Endpoints: append([]Endpoint(nil), node.Endpoints...)})
+}
+
+// add adds a node to its bucket. If the bucket is full and cannot split, the oldest node is pinged
+// without the lock, which the ping response takes, see markResponded.
+func (tree *BucketTree) add(node *Node) error {
+	tree.lock.Lock()
+	oldNode, err := tree.bucket(node.ID).add(node)
+	caps := tree.Self.Capabilities
+	tree.lock.Unlock()
+	if oldNode == nil {
+		return err
+	}
+	alive := tree.server.pingTimeout(oldNode, &caps, seconds(tree.config.RequestTimeout))
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	// The bucket may have split meanwhile.
+	tree.bucket(node.ID).replace(oldNode, node, alive)
+	return nil
+}
+
+// bucket returns the bucket an ID falls into.
+func (tree *BucketTree) bucket(id *NodeID) *Bucket {
+	return tree.Buckets[Min(CommonPrefixLength((*id)[:], (*tree.Self.ID)[:]), tree.MaxIndex)]
 }
 
 // Update a node forcely. If NodeID doesn't exist, do nothing.
 func (tree *BucketTree) Update(id *NodeID) error {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
 	predictedIndex := CommonPrefixLength((*id)[:], (*tree.Self.ID)[:])
 	index := Min(predictedIndex, tree.MaxIndex)
 	return tree.Buckets[index].update(id)
 }
 
+// sweepEvictions completes evictions whose pings have timed out, so that replacements get in
+// without waiting for another newcomer to arrive.
+func (tree *BucketTree) sweepEvictions() {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	now := tree.server.Clock.Now()
+	for index := 0; index <= tree.MaxIndex; index++ {
+		tree.Buckets[index].sweep(now)
+	}
+}
+
+// publish publishes an event on the server's bus, if the tree serves one.
+func (tree *BucketTree) publish(event Event) {
+	if tree.server != nil {
+		tree.server.Events.Publish(event)
+	}
+}
+
 // Bucket is the small bucket attached with BucketTree, containing Nodes.
 // fresh nodes tend to be close to Queue's back.
 type Bucket struct {
@@ -87,6 +299,11 @@ type Bucket struct {
 	tree  *BucketTree
 	Map   map[[NodeIDLength]byte]*list.Element
 	Queue *list.List // Element *Node
+
+	// Stateless eviction, see evict.
+	replacements []*Node // Newcomers waiting for a slot, the newest at the end.
+	pingedID     *NodeID // The oldest node being pinged.
+	pingedTime   time.Time
 }
 
 // GobEncode for GobEncoder
@@ -100,8 +317,8 @@ func (bucket *Bucket) GobEncode() ([]byte, error) {
 		_nodeSlice[_i] = _e.Value.(*Node)
 		_i++
 	}
-	enc.Encode(_nodeSlice)
-	return buffer.Bytes(), nil
+	err := enc.Encode(_nodeSlice)
+	return buffer.Bytes(), err
 }
 
 // GobDecode for GobDecoder
@@ -111,7 +328,11 @@ func (bucket *Bucket) GobDecode(data []byte) error {
 	bucket.Index = int(index)
 	var _nodeSlice []*Node
 	dec := gob.NewDecoder(buffer)
-	dec.Decode(&_nodeSlice)
+	if err := dec.Decode(&_nodeSlice); err != nil {
+		return err
+	}
+	bucket.Map = make(map[[NodeIDLength]byte]*list.Element, len(_nodeSlice))
+	bucket.Queue = list.New()
 	for _, _v := range _nodeSlice {
 		_e := bucket.Queue.PushBack(_v)
 		bucket.Map[*(_v.ID)] = _e
@@ -121,7 +342,7 @@ func (bucket *Bucket) GobDecode(data []byte) error {
 
 // getN returns at most N nodes except for a given node from this bucket.
 func (bucket *Bucket) getN(n int, exNode *NodeID) []*Node {
-	result := make([]*Node, 0, K)
+	result := make([]*Node, 0, n)
 	for ele := bucket.Queue.Back(); ele != nil; ele = ele.Prev() {
 		curNode := ele.Value.(*Node)
 		if *(curNode.ID) == *exNode {
@@ -138,33 +359,44 @@ func (bucket *Bucket) update(id *NodeID) error {
 		return errors.New("no such Node.")
 	}
 	bucket.Queue.MoveToBack(ptrElement)
+	if bucket.pingedID != nil && *bucket.pingedID == *id {
+		bucket.pingedID = nil // Survived eviction.
+	}
 	return nil
 }
 
-func (bucket *Bucket) add(ptrNode *Node) error {
+// add adds a node to the bucket. If the bucket is full and cannot split, the oldest node is returned
+// to be pinged, see replace.
+func (bucket *Bucket) add(ptrNode *Node) (*Node, error) {
 	ptrElement, isExist := bucket.Map[*ptrNode.ID]
 	// # Familiar node
 	if isExist {
 		ptrOldNode := ptrElement.Value.(*Node)
 		// Familiar and inconsistent
-		if ptrOldNode.Address.String() != ptrNode.Address.String() {
-			ptrOldNode.Address = ptrNode.Address
+		if !SameAddr(ptrOldNode.Address, ptrNode.Address) {
+			oldAddress := ptrOldNode.Address
+			ptrOldNode.Address, ptrOldNode.responded = ptrNode.Address, false
+			bucket.tree.publish(ContactAddressChanged{*ptrOldNode, oldAddress})
+		}
+		if ptrNode.Endpoints != nil {
+			ptrOldNode.Endpoints = ptrNode.Endpoints
 		}
 		bucket.Queue.MoveToBack(ptrElement)
-		return nil
+		return nil, nil
 	}
 	// # Unfamiliar node
 	// ## Not full
-	if len(bucket.Map) < K {
+	if len(bucket.Map) < bucket.tree.config.K {
 		ptrElement = bucket.Queue.PushBack(ptrNode)
 		bucket.Map[*ptrNode.ID] = ptrElement
-		return nil
+		bucket.tree.publish(ContactAdded{*ptrNode})
+		return nil, nil
 	}
 	// ## Full
 	// ### Split
 	if (bucket.Index == bucket.tree.MaxIndex) && (bucket.Index < (NodeIDLength*8 - 1)) {
 		newIndex := bucket.Index + 1
-		nextBucket := &Bucket{newIndex, bucket.tree, make(map[[NodeIDLength]byte]*list.Element, K), list.New()}
+		nextBucket := &Bucket{Index: newIndex, tree: bucket.tree, Map: make(map[[NodeIDLength]byte]*list.Element, bucket.tree.config.K), Queue: list.New()}
 		bucket.tree.Buckets[newIndex] = nextBucket
 		bucket.tree.MaxIndex++
 
@@ -179,7 +411,7 @@ func (bucket *Bucket) add(ptrNode *Node) error {
 			if CommonPrefixLength((*bucket.tree.Self.ID)[:], (*value.ID)[:]) != bucket.Index {
 				bucket.Queue.Remove(p)
 				delete(bucket.Map, *value.ID)
-				nextBucket.add(value)
+				nextBucket.Map[*value.ID] = nextBucket.Queue.PushBack(value) // Moved rather than added.
 			}
 		}
 		// Reprocess this request
@@ -189,14 +421,84 @@ func (bucket *Bucket) add(ptrNode *Node) error {
 		return bucket.add(ptrNode)
 	}
 	// ### Unsplit
-	oldElement := bucket.Queue.Front() // Get oldest ptrElement to compare
-	// Ping oldElement, if good then update and return, else remove and replace with the new one
-	if bucket.tree.server.Ping(oldElement.Value.(*Node)) {
-		bucket.Queue.MoveToBack(oldElement)
-		return nil
+	if bucket.tree.config.StatelessCookies {
+		bucket.evict(ptrNode)
+		return nil, nil
+	}
+	oldNode := *bucket.Queue.Front().Value.(*Node) // Copied since the ping goes without the lock.
+	return &oldNode, nil
+}
+
+// replace finishes adding a newcomer to a full bucket once its oldest node has been pinged.
+// A live oldest node stays, otherwise the newcomer takes its place.
+func (bucket *Bucket) replace(oldNode, ptrNode *Node, alive bool) {
+	if _, isExist := bucket.Map[*ptrNode.ID]; isExist {
+		return // Added meanwhile.
+	}
+	oldElement, isExist := bucket.Map[*oldNode.ID]
+	if alive {
+		if isExist {
+			bucket.Queue.MoveToBack(oldElement)
+		}
+		return
+	}
+	if isExist {
+		bucket.Queue.Remove(oldElement)
+		delete(bucket.Map, *oldNode.ID)
+		bucket.tree.publish(ContactEvicted{*oldElement.Value.(*Node)})
+	}
+	if len(bucket.Map) < bucket.tree.config.K {
+		bucket.Map[*ptrNode.ID] = bucket.Queue.PushBack(ptrNode)
+		bucket.tree.publish(ContactAdded{*ptrNode})
+	}
+}
+
+// evict makes room for a newcomer in a full bucket without waiting for a ping.
+// The newcomer waits among at most K replacements while the oldest node is pinged with a stateless cookie.
+// A response moves the oldest node to the back, see Server.reNotified. Otherwise it is replaced by
+// the newest replacement once the ping is older than RequestTimeout, see sweep.
+func (bucket *Bucket) evict(ptrNode *Node) {
+	for i, node := range bucket.replacements {
+		if *node.ID == *ptrNode.ID {
+			bucket.replacements = append(bucket.replacements[:i], bucket.replacements[i+1:]...)
+			break
+		}
+	}
+	if len(bucket.replacements) >= bucket.tree.config.K {
+		bucket.replacements = bucket.replacements[1:]
+	}
+	bucket.replacements = append(bucket.replacements, ptrNode)
+
+	oldNode := bucket.Queue.Front().Value.(*Node)
+	now := bucket.tree.server.Clock.Now()
+	if bucket.pingedID == nil || *bucket.pingedID != *oldNode.ID {
+		// Not pinged yet, or the pinged one has responded.
+		bucket.pingedID, bucket.pingedTime = oldNode.ID, now
+		bucket.tree.server.notify(Ping, NewPing(&bucket.tree.Self.Capabilities), oldNode.Address)
+		return
 	}
+	bucket.sweep(now)
+}
+
+// sweep replaces the pinged oldest node by the newest replacement if the ping is older than RequestTimeout.
+func (bucket *Bucket) sweep(now time.Time) {
+	oldElement := bucket.Queue.Front()
+	if bucket.pingedID == nil || len(bucket.replacements) == 0 || oldElement == nil ||
+		*oldElement.Value.(*Node).ID != *bucket.pingedID || now.Sub(bucket.pingedTime) < seconds(bucket.tree.config.RequestTimeout) {
+		return
+	}
+	oldNode := oldElement.Value.(*Node)
 	bucket.Queue.Remove(oldElement)
-	newElement := bucket.Queue.PushBack(ptrNode)
-	bucket.Map[*ptrNode.ID] = newElement
-	return nil
+	delete(bucket.Map, *oldNode.ID)
+	bucket.pingedID = nil
+	bucket.tree.publish(ContactEvicted{*oldNode})
+	for len(bucket.replacements) > 0 {
+		newcomer := bucket.replacements[len(bucket.replacements)-1]
+		bucket.replacements = bucket.replacements[:len(bucket.replacements)-1]
+		if _, isExist := bucket.Map[*newcomer.ID]; !isExist {
+			bucket.Map[*newcomer.ID] = bucket.Queue.PushBack(newcomer)
+			bucket.tree.publish(ContactAdded{*newcomer})
+			return
+		}
+	}
 }
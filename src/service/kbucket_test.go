@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSweepEvictions(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.K = 1
+	cfg.StatelessCookies = true
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	cfg.RequestTimeout = 2
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork(1)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	server := NewServerOn(NewBucketTree(cfg), cfg, clock, conn)
+	server.StartService()
+	defer server.Stop(context.Background())
+
+	// Both fall into bucket 0, which is full with the first one. The first one never responds.
+	oldID, newID := *server.KBuckets.Self.ID, *server.KBuckets.Self.ID
+	oldID[0] ^= 0x80
+	newID[0] ^= 0x80
+	newID[NodeIDLength-1] ^= 1
+	server.KBuckets.Add(&oldID, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321})
+	server.KBuckets.Add(&newID, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 54321})
+	if server.KBuckets.Get(&newID) != nil {
+		t.Fatal("newcomer got in before the oldest node was pinged")
+	}
+
+	// No further newcomer arrives, the sweep replaces the silent node.
+	waitFor(t, "eviction", func() bool {
+		clock.Advance(time.Second)
+		return server.KBuckets.Get(&newID) != nil && server.KBuckets.Get(&oldID) == nil
+	})
+}
+
+func TestFullBucketEviction(t *testing.T) {
+	network := NewMemNetwork(1)
+	peer := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+	cfg := DefaultConfig()
+	cfg.K = 1
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	cfg.RequestTimeout = 0.5
+	// Local node is placed so that the peer and both newcomers fall into bucket 0, which cannot split any more
+	// once the first newcomer has split it.
+	tree := NewBucketTree(cfg)
+	selfID := *peer.KBuckets.Self.ID
+	selfID[0] ^= 0x80
+	tree.Self.ID = &selfID
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	server := NewServerOn(tree, cfg, network.Clock, conn)
+	server.StartService()
+	defer server.Stop(context.Background())
+
+	newcomer := func(last byte) *NodeID {
+		id := *peer.KBuckets.Self.ID
+		id[NodeIDLength-1] ^= last
+		return &id
+	}
+	p := peer.KBuckets.SelfNode()
+	server.KBuckets.Add(p.ID, p.Address)
+
+	// The peer responds, thus it stays and the newcomer is dropped.
+	first := newcomer(1)
+	if err := server.KBuckets.Add(first, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 54321}); err != nil {
+		t.Fatal(err)
+	}
+	if server.KBuckets.Get(first) != nil || server.KBuckets.Get(p.ID) == nil {
+		t.Fatal("a responding node was evicted")
+	}
+
+	// Once the peer is gone, the next newcomer takes its place.
+	peer.Stop(context.Background())
+	second := newcomer(2)
+	if err := server.KBuckets.Add(second, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 4), Port: 54321}); err != nil {
+		t.Fatal(err)
+	}
+	if server.KBuckets.Get(second) == nil || server.KBuckets.Get(p.ID) != nil {
+		t.Fatal("a silent node was not evicted")
+	}
+}
+
+// idAt returns an ID sharing a common prefix of length cpl with id. n tells apart IDs of the same prefix.
+func idAt(id *NodeID, cpl int, n byte) *NodeID {
+	result := *id
+	result[cpl/8] ^= 0x80 >> (cpl % 8)
+	result[NodeIDLength-1] ^= n << 1
+	return &result
+}
+
+func TestBucketTreeSnapshot(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.K = 2
+	tree := NewBucketTree(cfg)
+	relay := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}
+	tree.Self.Endpoints = []Endpoint{{TransportRelay, &RelayAddr{relay, *tree.Self.ID}}}
+	// Two nodes for each of the buckets 2, 1 and 0, which are split in turn.
+	var nodes []*Node
+	for cpl := 2; cpl >= 0; cpl-- {
+		for n := byte(1); n <= 2; n++ {
+			id := idAt(tree.Self.ID, cpl, n)
+			node := &Node{ID: id, Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(len(nodes)+2)), Port: 54321}}
+			if n == 2 {
+				node.Address = &RelayAddr{relay, *id}
+				node.Endpoints = []Endpoint{{TransportXMPP, JIDAddr("alice@localhost")}}
+			}
+			if err := tree.AddNode(node); err != nil {
+				t.Fatal(err)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	if tree.MaxIndex != 2 {
+		t.Fatalf("split into %d buckets", tree.MaxIndex+1)
+	}
+
+	path := filepath.Join(t.TempDir(), "buckets")
+	if err := tree.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBucketTree(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded.Self.ID != *tree.Self.ID || loaded.Self.Endpoints != nil || loaded.MaxIndex != tree.MaxIndex {
+		t.Fatalf("loaded %s with endpoints %v and %d buckets", loaded.Self, loaded.Self.Endpoints, loaded.MaxIndex+1)
+	}
+	for _, node := range nodes {
+		got := loaded.Get(node.ID)
+		if got == nil || !SameAddr(got.Address, node.Address) || len(got.Endpoints) != len(node.Endpoints) {
+			t.Fatalf("loaded %v, want %s", got, node)
+		}
+	}
+	for index := 0; index <= tree.MaxIndex; index++ {
+		want, got := tree.BucketNodes(index), loaded.BucketNodes(index)
+		for i := range want {
+			if len(got) != len(want) || *got[i].ID != *want[i].ID {
+				t.Fatalf("bucket %d loaded out of order", index)
+			}
+		}
+	}
+
+	// A snapshot cut short or overwritten is refused rather than loaded partly.
+	data, _ := os.ReadFile(path)
+	for name, corrupt := range map[string][]byte{
+		"empty":     {},
+		"truncated": data[:len(data)/2],
+		"garbage":   append([]byte("rumor"), data[5:]...),
+	} {
+		os.WriteFile(path, corrupt, 0600)
+		if _, err := LoadBucketTree(path, cfg); err == nil {
+			t.Fatalf("%s snapshot is loaded", name)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Keepalive:
+NAT bindings expire after a period of silence. Keepalive pings a few fresh contacts whenever local node
+has been silent for an interval, which is kept below the binding lifetime.
+
+The lifetime is learned by probing: a Probe request asks a peer to respond after a delay. If the response
+arrives, the binding survived the delay. The delay is binary searched between the longest succeeded and the
+shortest failed one. Any outgoing traffic refreshes the binding under endpoint-independent mapping, thus
+probes are sent from a separate socket, see Server.ListenProbe, whose binding nothing else refreshes.
+Keepalives go on meanwhile.
+*/
+
+// Fields of Probe.
+const (
+	probeDelay byte = iota + 1
+)
+
+// DataProbe is probe payload.
+// Request:  | Delay in seconds |
+// Response: empty
+type DataProbe struct {
+	Delay time.Duration
+	isReq bool
+}
+
+// NewProbe creates probe payload. delay is only used for a request.
+func NewProbe(isReq bool, delay time.Duration) *DataProbe {
+	return &DataProbe{delay, isReq}
+}
+
+// Encode encodes the payload.
+func (probe *DataProbe) Encode(encoder *Encoder) {
+	if probe.isReq {
+		encoder.Uint(probeDelay, uint64(probe.Delay/time.Second))
+	}
+}
+
+// Decode decodes the payload.
+func (probe *DataProbe) Decode(decoder *Decoder, isReq bool) error {
+	probe.isReq = isReq
+	hasDelay := false
+	for decoder.Next() {
+		if decoder.Tag() == probeDelay {
+			probe.Delay, hasDelay = time.Duration(decoder.Uint(math.MaxUint16))*time.Second, true
+		}
+	}
+	if decoder.Err() == nil && isReq && !hasDelay {
+		return missing("delay")
+	}
+	return decoder.Err()
+}
+
+// Keepalive schedules keepalives and learns NAT binding lifetime.
+type Keepalive struct {
+	server   *Server
+	lower    time.Duration // The longest probe succeeded.
+	upper    time.Duration // The shortest probe failed.
+	lastSent time.Time
+	probing  bool
+	lock     *sync.Mutex
+}
+
+// newKeepalive creates a keepalive scheduler assuming the shortest common binding lifetime.
+func newKeepalive(server *Server) *Keepalive {
+	return &Keepalive{
+		server: server,
+		lower:  time.Duration(server.config.KeepaliveMinLifetime) * time.Second,
+		upper:  time.Duration(server.config.KeepaliveMaxProbe) * time.Second,
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Interval returns the current keepalive interval.
+// On a public address or a mapped port keepalive backs off to KeepalivePublicInterval,
+// otherwise it keeps a margin below the learned lifetime.
+func (keepalive *Keepalive) Interval() time.Duration {
+	if keepalive.server.KBuckets.SelfNode().Capabilities.NAT == NATOpen || keepalive.server.mappedAddr() != nil {
+		return time.Duration(keepalive.server.config.KeepalivePublicInterval) * time.Second
+	}
+	keepalive.lock.Lock()
+	defer keepalive.lock.Unlock()
+	return keepalive.lower * 4 / 5
+}
+
+// Lifetime returns the longest silence the binding was seen to survive.
+func (keepalive *Keepalive) Lifetime() time.Duration {
+	keepalive.lock.Lock()
+	defer keepalive.lock.Unlock()
+	return keepalive.lower
+}
+
+// sent records the time of outgoing traffic, which refreshes bindings as well as keepalives do.
+func (keepalive *Keepalive) sent() {
+	keepalive.lock.Lock()
+	keepalive.lastSent = keepalive.server.Clock.Now()
+	keepalive.lock.Unlock()
+}
+
+// run sends keepalives until the server stops.
+func (keepalive *Keepalive) run() {
+	for {
+		interval := keepalive.Interval()
+		keepalive.lock.Lock()
+		wait := interval - keepalive.server.Clock.Now().Sub(keepalive.lastSent)
+		keepalive.lock.Unlock()
+		if wait > 0 {
+			if !keepalive.server.sleep(wait) {
+				return
+			}
+			continue
+		}
+		caps := keepalive.server.KBuckets.SelfNode().Capabilities
+		contacts := keepalive.server.KBuckets.Freshest(keepalive.server.config.KeepaliveContacts)
+		for _, contact := range contacts {
+			contact := contact
+			keepalive.server.spawn(func() { keepalive.server.pingTimeout(contact, &caps, interval) })
+		}
+		for _, contact := range contacts {
+			if _, ok := contact.Address.(*net.UDPAddr); ok {
+				contact := contact
+				keepalive.server.spawn(func() { keepalive.probe(contact) })
+				break
+			}
+		}
+		// Keepalives are sent in background, thus the next round is an interval later rather than
+		// once they are recorded by sent.
+		if !keepalive.server.sleep(interval) {
+			return
+		}
+	}
+}
+
+// probe learns binding lifetime with a contact, unless converged or already probing.
+func (keepalive *Keepalive) probe(contact *Node) {
+	// Self is read before locking, since the tree lock is held while sending, see sent.
+	natType := keepalive.server.KBuckets.SelfNode().Capabilities.NAT
+	keepalive.lock.Lock()
+	if keepalive.probing || keepalive.upper-keepalive.lower <= time.Duration(keepalive.server.config.KeepaliveProbePrecision)*time.Second ||
+		natType == NATOpen || keepalive.server.ListenProbe == nil {
+		keepalive.lock.Unlock()
+		return
+	}
+	keepalive.probing = true
+	delay := (keepalive.lower + keepalive.upper) / 2
+	keepalive.lock.Unlock()
+
+	succeeded, err := keepalive.request(contact, delay)
+
+	keepalive.lock.Lock()
+	defer keepalive.lock.Unlock()
+	keepalive.probing = false
+	if err != nil {
+		log.Printf("NAT binding probe of %s failed: %s\n", delay, err)
+		return
+	}
+	if succeeded {
+		keepalive.lower = delay
+	} else {
+		keepalive.upper = delay
+	}
+	log.Printf("NAT binding probe of %s: %t, lifetime between %s and %s\n", delay, succeeded, keepalive.lower, keepalive.upper)
+}
+
+// request sends a probe from a new socket and tells whether the response arrives within delay and RequestTimeout.
+func (keepalive *Keepalive) request(contact *Node, delay time.Duration) (bool, error) {
+	server := keepalive.server
+	cookie := NewRandCookie()
+	if cookie == nil {
+		return false, errors.New("failed to create cookie")
+	}
+	request := NewDatagram(server.Clock, Probe, true, cookie, server.KBuckets.SelfNode(), NewProbe(true, delay))
+	if request == nil {
+		return false, errors.New("failed to create request")
+	}
+	conn, err := server.ListenProbe()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteTo(request.Dumps(), contact.Address); err != nil {
+		return false, err
+	}
+
+	// The reader exits once conn is closed.
+	responded := make(chan struct{})
+	go func() {
+		buffer := GetBuffer()
+		defer PutBuffer(buffer)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			response := AcquireDatagram()
+			matched := response.Loads(buffer[:n], addr) == nil && response.Type == Probe && !response.IsRequest &&
+				*response.MagicCookie == *cookie
+			response.Release()
+			if matched {
+				close(responded)
+				return
+			}
+		}
+	}()
+	elapsed, timer := after(server.Clock, delay+seconds(server.config.RequestTimeout))
+	defer timer.Stop()
+	select {
+	case <-responded:
+		return true, nil
+	case <-elapsed:
+		return false, nil
+	case <-server.stop:
+		return false, errors.New("server stopped")
+	}
+}
+
+// response Probe request after the requested delay. The response is scheduled rather than waited for,
+// and responses waiting at once are limited, see delayedProbes.
+func (server *Server) reProbe(datagram *Datagram) {
+	probe, ok := datagram.Data.(*DataProbe)
+	if !ok {
+		return
+	}
+	delay := probe.Delay
+	if delay > time.Duration(server.config.KeepaliveMaxProbe)*time.Second {
+		return
+	}
+	// A relayed binding is not what the requester probes.
+	udpAddr, ok := datagram.SourceNode.Address.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	ip := udpAddr.IP.String()
+	if !server.delayedProbes.acquire(ip) {
+		return
+	}
+	// The datagram is released once handled, thus the response refers to a copy.
+	request := datagram.Clone()
+	server.Clock.AfterFunc(delay, func() {
+		defer server.delayedProbes.release(ip)
+		// Stop waits for spawned functions, so that nothing is sent through closed sockets.
+		if !server.spawn(func() {
+			server.reply(request, NewProbe(false, 0))
+			request.Release()
+		}) {
+			request.Release()
+		}
+	})
+}
+
+// Limits of delayed probe responses.
+const (
+	maxDelayedProbes      = 1024
+	maxDelayedProbesPerIP = 4
+)
+
+// delayedProbes counts probe responses waiting for their delay, in total and per requester IP.
+type delayedProbes struct {
+	total int
+	perIP map[string]int
+	lock  sync.Mutex
+}
+
+func newDelayedProbes() *delayedProbes {
+	return &delayedProbes{perIP: make(map[string]int)}
+}
+
+// acquire takes a slot for a response to ip. Return false if none is left.
+func (delayed *delayedProbes) acquire(ip string) bool {
+	delayed.lock.Lock()
+	defer delayed.lock.Unlock()
+	if delayed.total >= maxDelayedProbes || delayed.perIP[ip] >= maxDelayedProbesPerIP {
+		return false
+	}
+	delayed.total++
+	delayed.perIP[ip]++
+	return true
+}
+
+// release gives a slot back.
+func (delayed *delayedProbes) release(ip string) {
+	delayed.lock.Lock()
+	defer delayed.lock.Unlock()
+	delayed.total--
+	if delayed.perIP[ip]--; delayed.perIP[ip] == 0 {
+		delete(delayed.perIP, ip)
+	}
+}
+
+// Freshest returns at most n most recently seen nodes, collected from the deepest buckets.
+func (tree *BucketTree) Freshest(n int) []*Node {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	result := make([]*Node, 0, n)
+	for index := tree.MaxIndex; index >= 0 && len(result) < n; index-- {
+		for ele := tree.Buckets[index].Queue.Back(); ele != nil && len(result) < n; ele = ele.Prev() {
+			node := ele.Value.(*Node)
+			if _, isRelayed := node.Address.(*RelayAddr); !isRelayed {
+				result = append(result, node)
+			}
+		}
+	}
+	return result
+}
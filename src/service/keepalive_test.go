@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newKeepaliveServer starts a server on addr of network, behind nat if not nil, which keeps alive with
+// contacts. Probes are sent from free ports of addr.
+func newKeepaliveServer(t *testing.T, network *MemNetwork, addr *net.UDPAddr, nat *MemNAT, minLifetime, maxProbe, contacts int) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	cfg.RequestTimeout = 2
+	cfg.KeepaliveContacts = contacts
+	cfg.KeepaliveMinLifetime, cfg.KeepaliveMaxProbe = minLifetime, maxProbe
+	cfg.KeepalivePublicInterval = minLifetime
+	conn, err := network.Listen(addr, nat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServerOn(NewBucketTree(cfg), cfg, network.Clock, conn)
+	server.ListenProbe = func() (net.PacketConn, error) {
+		conn, err := network.Listen(&net.UDPAddr{IP: addr.IP}, nat)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	server.StartService()
+	t.Cleanup(func() { server.Stop(context.Background()) })
+	return server
+}
+
+// tick advances clock for d, stopping by every scheduled function and at least every second, so that woken up
+// goroutines get a moment to run in between.
+func tick(clock *FakeClock, d time.Duration) {
+	for end := clock.Now().Add(d); clock.Now().Before(end); {
+		step := time.Second
+		if next, ok := clock.Next(); ok && next.Sub(clock.Now()) < step {
+			step = next.Sub(clock.Now())
+		}
+		if rest := end.Sub(clock.Now()); rest < step {
+			step = rest
+		}
+		clock.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeepaliveInterval(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork(1)
+	network.Clock = clock
+	// Probing has converged at once.
+	server := newKeepaliveServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil, 20, 20, 1)
+	contact, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+	server.KBuckets.Add(NewRandNodeID(), contact.LocalAddr())
+
+	// Keepalives go out every 16 seconds, which is 4/5 of the lifetime, although nobody responds.
+	pings := 0
+	for i := 0; i < 100; i++ {
+		tick(clock, time.Second)
+		for _, packet := range received(contact) {
+			var datagram Datagram
+			if datagram.Loads(packet.data, packet.from) == nil && datagram.Type == Ping && datagram.IsRequest {
+				pings++
+			}
+		}
+	}
+	if pings < 6 || pings > 8 {
+		t.Fatalf("%d keepalives in 100 seconds", pings)
+	}
+}
+
+func TestKeepaliveProbe(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork(1)
+	network.Clock = clock
+	peer := newKeepaliveServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil, 20, 180, 0)
+	nat, _ := network.NewNAT(NATPortRestricted, net.IPv4(203, 0, 113, 1), 47*time.Second)
+	server := newKeepaliveServer(t, network, &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nat, 20, 180, 1)
+	p := peer.KBuckets.SelfNode()
+	server.KBuckets.Add(p.ID, p.Address)
+	events := peer.Events.Subscribe(256)
+	defer events.Close()
+
+	// Probes of 100s and 60s fail, 40s succeeds, 50s fails and 45s succeeds, which is within the precision.
+	for i := 0; i < 500 && server.Keepalive.Lifetime() != 45*time.Second; i++ {
+		tick(clock, time.Second)
+	}
+	keepalive := server.Keepalive
+	keepalive.lock.Lock()
+	lower, upper := keepalive.lower, keepalive.upper
+	keepalive.lock.Unlock()
+	if lower != 45*time.Second || upper != 50*time.Second {
+		t.Fatalf("lifetime between %s and %s", lower, upper)
+	}
+
+	// Keepalives went on meanwhile from one binding, where the peer knows local node rather than at a probing socket.
+	keepalives := 0
+	var addr net.Addr
+	for len(events.C) > 0 {
+		if event, ok := (<-events.C).(RequestArrived); ok && event.Type == Ping {
+			if addr != nil && !SameAddr(event.Source.Address, addr) {
+				t.Fatalf("keepalives from %s and %s", addr, event.Source.Address)
+			}
+			addr = event.Source.Address
+			keepalives++
+		}
+	}
+	if keepalives < 10 {
+		t.Fatalf("%d keepalives while probing", keepalives)
+	}
+	if contact := peer.KBuckets.Get(server.KBuckets.Self.ID); contact == nil || !SameAddr(contact.Address, addr) {
+		t.Fatalf("local node known at %v", contact)
+	}
+}
+
+func TestProbeResponsesLimited(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	network := NewMemNetwork(1)
+	network.Clock = clock
+	server := newKeepaliveServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil, 20, 180, 0)
+	prober, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+	self := &Node{ID: NewRandNodeID(), Address: prober.LocalAddr()}
+
+	// Responses to an IP are limited while waiting, but do not hold workers, so that a ping is still responded.
+	for i := 0; i < 2*maxDelayedProbesPerIP; i++ {
+		prober.WriteTo(NewDatagram(clock, Probe, true, NewRandCookie(), self, NewProbe(true, time.Minute)).Dumps(), server.conn.LocalAddr())
+	}
+	prober.WriteTo(NewDatagram(clock, Ping, true, NewRandCookie(), self, NewPing(nil)).Dumps(), server.conn.LocalAddr())
+	responses := make(map[byte]int)
+	receive := func() {
+		for _, packet := range received(prober) {
+			var datagram Datagram
+			if datagram.Loads(packet.data, packet.from) == nil && !datagram.IsRequest {
+				responses[datagram.Type]++
+			}
+		}
+	}
+	for i := 0; i < 10 && responses[Ping] == 0; i++ {
+		tick(clock, time.Second)
+		receive()
+	}
+	if responses[Ping] != 1 || responses[Probe] != 0 {
+		t.Fatalf("responded before the delay: %v", responses)
+	}
+	tick(clock, time.Minute)
+	receive()
+	if responses[Probe] != maxDelayedProbesPerIP {
+		t.Fatalf("%d probes responded", responses[Probe])
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+/*
+Lookup:
+A node lookup finds the K nodes closest to a target ID by asking closer and closer nodes, as Kademlia does.
+Each round asks LookupParallelism closest unasked nodes among the K closest known ones for their contacts
+closest to the target, until all of the K closest known nodes have been asked. Unresponsive nodes are dropped.
+*/
+
+// Fields of FindNode.
+const (
+	findNodeTarget byte = iota + 1
+	findNodeContact
+)
+
+// DataFindNode is the payload of FindNode.
+// Request:  | Target NodeID |
+// Response: | Contact | Contact | ... |
+type DataFindNode struct {
+	Target   *NodeID
+	Contacts []*Node
+}
+
+// NewFindNode creates a FindNode payload. A request carries the target, a response carries contacts.
+// Contacts exceeding the datagram are left out.
+func NewFindNode(isReq bool, target *NodeID, contacts []*Node) *DataFindNode {
+	if isReq {
+		return &DataFindNode{Target: target}
+	}
+	// Room is kept for the observed address, see DataObserved.
+	room := MaxPayloadSize - FieldSize(net.IPv6len+2)
+	payload := &DataFindNode{}
+	for _, contact := range contacts {
+		bytes := contact.Dumps()
+		if bytes == nil || FieldSize(len(bytes)) > room {
+			continue
+		}
+		room -= FieldSize(len(bytes))
+		payload.Contacts = append(payload.Contacts, contact)
+	}
+	return payload
+}
+
+// Encode encodes the payload.
+func (payload *DataFindNode) Encode(encoder *Encoder) {
+	if payload.Target != nil {
+		encoder.ID(findNodeTarget, payload.Target)
+	}
+	for _, contact := range payload.Contacts {
+		encoder.Contact(findNodeContact, contact)
+	}
+}
+
+// Decode decodes the payload.
+func (payload *DataFindNode) Decode(decoder *Decoder, isReq bool) error {
+	for decoder.Next() {
+		switch decoder.Tag() {
+		case findNodeTarget:
+			payload.Target = decoder.ID()
+		case findNodeContact:
+			if contact := decoder.Contact(); contact != nil {
+				payload.Contacts = append(payload.Contacts, contact)
+			}
+		}
+	}
+	if decoder.Err() == nil && isReq && payload.Target == nil {
+		return missing("target")
+	}
+	return decoder.Err()
+}
+
+// LookupResult reports a node lookup.
+type LookupResult struct {
+	Closest []*Node // At most K responsive nodes closest to the target, the closest first.
+	Hops    int     // Hops from local node to the closest one, 0 if it is a local contact.
+	Rounds  int     // Rounds of requests.
+	Queried int     // Nodes asked.
+	Failed  int     // Nodes not responding.
+}
+
+// Found tells whether the target itself is among the closest nodes.
+func (result *LookupResult) Found(target *NodeID) bool {
+	return len(result.Closest) > 0 && *result.Closest[0].ID == *target
+}
+
+// lookupCandidate is a node known in a lookup.
+type lookupCandidate struct {
+	node  *Node
+	hops  int
+	asked bool
+}
+
+// Lookup finds the K nodes closest to target.
+func (server *Server) Lookup(target *NodeID) *LookupResult {
+	k, alpha := server.config.K, server.config.LookupParallelism
+	result := &LookupResult{}
+	seen := map[NodeID]bool{*server.KBuckets.Self.ID: true}
+	var candidates []*lookupCandidate
+	learn := func(nodes []*Node, hops int) {
+		for _, node := range nodes {
+			if !seen[*node.ID] {
+				seen[*node.ID] = true
+				candidates = append(candidates, &lookupCandidate{node: node, hops: hops})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return Closer(candidates[i].node.ID, candidates[j].node.ID, target)
+		})
+	}
+	// GetK excludes the target, which may be a local contact.
+	if node := server.KBuckets.Get(target); node != nil {
+		learn([]*Node{node}, 0)
+	}
+	learn(server.KBuckets.GetK(target), 0)
+
+	type response struct {
+		candidate *lookupCandidate
+		contacts  []*Node
+		err       error
+	}
+	for {
+		var asking []*lookupCandidate
+		for i := 0; i < len(candidates) && i < k && len(asking) < alpha; i++ {
+			if !candidates[i].asked {
+				candidates[i].asked = true
+				asking = append(asking, candidates[i])
+			}
+		}
+		if len(asking) == 0 {
+			break
+		}
+		result.Rounds++
+		responses := make(chan response, len(asking))
+		for _, candidate := range asking {
+			go func(candidate *lookupCandidate) {
+				contacts, err := server.findNode(candidate.node, target)
+				responses <- response{candidate, contacts, err}
+			}(candidate)
+		}
+		for range asking {
+			res := <-responses
+			result.Queried++
+			if res.err != nil {
+				result.Failed++
+				for i, candidate := range candidates {
+					if candidate == res.candidate {
+						candidates = append(candidates[:i], candidates[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+			learn(res.contacts, res.candidate.hops+1)
+		}
+	}
+
+	for i := 0; i < len(candidates) && i < k; i++ {
+		result.Closest = append(result.Closest, candidates[i].node)
+	}
+	if len(candidates) > 0 {
+		result.Hops = candidates[0].hops
+	}
+	return result
+}
+
+// findNode asks a node for its contacts closest to target.
+func (server *Server) findNode(node *Node, target *NodeID) ([]*Node, error) {
+	resDatagram := server.request(FindNode, NewFindNode(true, target, nil), node.Address, seconds(server.config.RequestTimeout))
+	if resDatagram == nil {
+		return nil, errors.New("node did not respond")
+	}
+	defer resDatagram.Release()
+	payload, ok := resDatagram.Data.(*DataFindNode)
+	if !ok {
+		return nil, errors.New("node responded with another message type")
+	}
+	return payload.Contacts, nil
+}
+
+// response FindNode request with local contacts closest to the target, except the requester.
+func (server *Server) reFindNode(datagram *Datagram) {
+	payload, ok := datagram.Data.(*DataFindNode)
+	if !ok {
+		return
+	}
+	target := payload.Target
+	var contacts []*Node
+	if node := server.KBuckets.Get(target); node != nil {
+		contacts = append(contacts, node)
+	}
+	for _, contact := range server.KBuckets.GetK(target) {
+		if *contact.ID != *datagram.SourceNode.ID {
+			contacts = append(contacts, contact)
+		}
+	}
+	server.reply(datagram, NewFindNode(false, nil, contacts))
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// NATType is the NAT behaviour classified by RFC 5780 tests, named after the classic RFC 3489 types.
+type NATType byte
+
+// Define NAT types
+const (
+	NATUnknown        NATType = iota
+	NATOpen                   // No NAT, reachable directly.
+	NATFullCone               // Endpoint-independent mapping and filtering.
+	NATRestricted             // Endpoint-independent mapping, address-dependent filtering.
+	NATPortRestricted         // Endpoint-independent mapping, address and port-dependent filtering.
+	NATSymmetric              // Mapping depends on destination, hole punching hardly works.
+	NATBlocked                // UDP seems blocked.
+)
+
+func (natType NATType) String() string {
+	switch natType {
+	case NATOpen:
+		return "open"
+	case NATFullCone:
+		return "full-cone"
+	case NATRestricted:
+		return "restricted"
+	case NATPortRestricted:
+		return "port-restricted"
+	case NATSymmetric:
+		return "symmetric"
+	case NATBlocked:
+		return "blocked"
+	}
+	return "unknown"
+}
+
+// STUN attributes of RFC 5780.
+const (
+	stunAttrChangeRequest  uint16 = 0x0003
+	stunAttrResponseOrigin uint16 = 0x802B
+	stunAttrOtherAddress   uint16 = 0x802C
+
+	stunChangeIP   byte = 0x04
+	stunChangePort byte = 0x02
+)
+
+// ErrNoRFC5780 means the STUN server does not support NAT behaviour discovery.
+var ErrNoRFC5780 = errors.New("stun server does not support RFC 5780")
+
+// DiscoverNAT classifies the NAT in front of the client by a STUN server supporting RFC 5780.
+// localPort is the port the client's conn listens on, used to recognize a node without NAT.
+// A filtered response is expected to be lost, thus filtering tests wait a few round trips of mapping test I
+// rather than the whole timeout.
+func (client *STUNClient) DiscoverNAT(server net.Addr, localPort int, timeout time.Duration) (NATType, error) {
+	// Mapping test I: the primary address.
+	start := client.clock.Now()
+	res, err := client.roundTrip(server, nil, timeout)
+	if err != nil {
+		return NATBlocked, err
+	}
+	filterTimeout := 4*client.clock.Now().Sub(start) + 200*time.Millisecond
+	if filterTimeout > timeout {
+		filterTimeout = timeout
+	}
+	mapped1 := mappedAddress(res)
+	otherValue, isExist := res.Attributes[stunAttrOtherAddress]
+	if mapped1 == nil || !isExist {
+		return NATUnknown, ErrNoRFC5780
+	}
+	other := loadSTUNAddress(otherValue, nil)
+	primary, ok := server.(*net.UDPAddr)
+	if other == nil || !ok {
+		return NATUnknown, ErrNoRFC5780
+	}
+	if mapped1.Port == localPort && isLocalIP(mapped1.IP) {
+		return NATOpen, nil
+	}
+
+	// Filtering test II asks the server to respond from the alternate IP and port, test III from the alternate
+	// port only. They are independent, thus run together, and before anything is sent to the alternate IP,
+	// which would open the filter of a restricted NAT to it.
+	changeBoth := map[uint16][]byte{stunAttrChangeRequest: {0, 0, 0, stunChangeIP | stunChangePort}}
+	changePort := map[uint16][]byte{stunAttrChangeRequest: {0, 0, 0, stunChangePort}}
+	portResult := make(chan error, 1)
+	go func() {
+		_, err := client.roundTrip(server, changePort, filterTimeout)
+		portResult <- err
+	}()
+	_, bothErr := client.roundTrip(server, changeBoth, filterTimeout)
+	portErr := <-portResult
+
+	// Mapping test II: the alternate IP with primary port.
+	res, err = client.roundTrip(&net.UDPAddr{IP: other.IP, Port: primary.Port}, nil, timeout)
+	if err != nil {
+		return NATUnknown, err
+	}
+	mapped2 := mappedAddress(res)
+	if mapped2 == nil {
+		return NATUnknown, errors.New("stun response carries no mapped address")
+	}
+	switch {
+	case !SameAddr(mapped1, mapped2):
+		// Address or address and port-dependent mapping, both are regarded as symmetric.
+		return NATSymmetric, nil
+	case bothErr == nil:
+		return NATFullCone, nil
+	case portErr == nil:
+		return NATRestricted, nil
+	}
+	return NATPortRestricted, nil
+}
+
+// ClassifyMapping tells a symmetric NAT from others by comparing addresses mapped by two STUN servers, for use
+// when no server supports RFC 5780. Filtering cannot be learned this way, so a NAT with endpoint-independent
+// mapping is regarded as port-restricted, the strictest of them.
+func (client *STUNClient) ClassifyMapping(servers []net.Addr, localPort int, timeout time.Duration) (NATType, error) {
+	var mapped []*net.UDPAddr
+	lastErr := errors.New("two stun servers needed")
+	for _, server := range servers {
+		addr, err := client.Binding(server, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if addr.Port == localPort && isLocalIP(addr.IP) {
+			return NATOpen, nil
+		}
+		if mapped = append(mapped, addr); len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) < 2 {
+		return NATUnknown, lastErr
+	}
+	if !SameAddr(mapped[0], mapped[1]) {
+		return NATSymmetric, nil
+	}
+	return NATPortRestricted, nil
+}
+
+// mappedAddress extracts the mapped address from a binding response.
+func mappedAddress(msg *stunMessage) *net.UDPAddr {
+	if value, isExist := msg.Attributes[stunAttrXorMappedAddress]; isExist {
+		return loadSTUNAddress(value, &msg.TransactionID)
+	}
+	if value, isExist := msg.Attributes[stunAttrMappedAddress]; isExist {
+		return loadSTUNAddress(value, nil)
+	}
+	return nil
+}
+
+// isLocalIP tells whether an IP belongs to a local interface.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// STUNServer is a STUN server supporting RFC 5780 behaviour discovery.
+// It needs four conns on two IPs and two ports:
+// [0] IP1:Port1 (primary), [1] IP1:Port2, [2] IP2:Port1, [3] IP2:Port2.
+type STUNServer struct {
+	Conns [4]net.PacketConn
+}
+
+// Serve serves on all four conns until any of them is closed.
+func (stunServer *STUNServer) Serve() error {
+	errChan := make(chan error, len(stunServer.Conns))
+	for i := range stunServer.Conns {
+		go func(i int) {
+			var buffer [MaxPackageSize]byte
+			for {
+				n, addr, err := stunServer.Conns[i].ReadFrom(buffer[:])
+				if err != nil {
+					errChan <- err
+					return
+				}
+				stunServer.handle(i, buffer[:n], addr)
+			}
+		}(i)
+	}
+	return <-errChan
+}
+
+// handle answers a binding request arriving at conn i, honouring CHANGE-REQUEST.
+func (stunServer *STUNServer) handle(i int, bytes []byte, addr net.Addr) {
+	req := loadSTUNMessage(bytes)
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if req == nil || req.Type != stunBindingReq || !ok {
+		return
+	}
+	from := i
+	if value, isExist := req.Attributes[stunAttrChangeRequest]; isExist && len(value) == 4 {
+		flags := binary.BigEndian.Uint32(value)
+		if flags&uint32(stunChangeIP) != 0 {
+			from ^= 2
+		}
+		if flags&uint32(stunChangePort) != 0 {
+			from ^= 1
+		}
+	}
+	origin, _ := stunServer.Conns[from].LocalAddr().(*net.UDPAddr)
+	other, _ := stunServer.Conns[i^3].LocalAddr().(*net.UDPAddr)
+	if origin == nil || other == nil {
+		return
+	}
+	res := &stunMessage{Type: stunBindingRes, TransactionID: req.TransactionID, Attributes: map[uint16][]byte{
+		stunAttrXorMappedAddress: dumpSTUNAddress(udpAddr, &req.TransactionID),
+		stunAttrResponseOrigin:   dumpSTUNAddress(origin, nil),
+		stunAttrOtherAddress:     dumpSTUNAddress(other, nil),
+	}}
+	stunServer.Conns[from].WriteTo(res.dumps(), addr)
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newMemSTUNServer serves RFC 5780 on two IPs and two ports of a network, returning the primary address.
+func newMemSTUNServer(t *testing.T, network *MemNetwork) net.Addr {
+	var stunServer STUNServer
+	for i, ip := range []net.IP{net.IPv4(198, 51, 100, 1), net.IPv4(198, 51, 100, 2)} {
+		for j, port := range []int{3478, 3479} {
+			conn, err := network.Listen(&net.UDPAddr{IP: ip, Port: port}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			stunServer.Conns[i*2+j] = conn
+		}
+	}
+	go stunServer.Serve()
+	return stunServer.Conns[0].LocalAddr()
+}
+
+// newMemSTUNClient creates a STUN client behind a NAT of natType on network.
+func newMemSTUNClient(t *testing.T, network *MemNetwork, natType NATType) *STUNClient {
+	nat, err := network.NewNAT(natType, net.IPv4(203, 0, 113, 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := NewSTUNClient(conn, SystemClock)
+	go serveSTUNClient(conn, client)
+	return client
+}
+
+func TestDiscoverNAT(t *testing.T) {
+	for _, natType := range []NATType{NATFullCone, NATRestricted, NATPortRestricted, NATSymmetric} {
+		t.Run(natType.String(), func(t *testing.T) {
+			network := NewMemNetwork(1)
+			server := newMemSTUNServer(t, network)
+			client := newMemSTUNClient(t, network, natType)
+			start := time.Now()
+			discovered, err := client.DiscoverNAT(server, 54321, 2*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if discovered != natType {
+				t.Fatalf("discovered %s", discovered)
+			}
+			// Filtered responses are not waited for the whole timeout.
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("discovery took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestDiscoverNATWithoutRFC5780(t *testing.T) {
+	network := NewMemNetwork(1)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 3478}, nil)
+	defer conn.Close()
+	go ServeSTUN(conn)
+	client := newMemSTUNClient(t, network, NATPortRestricted)
+	if _, err := client.DiscoverNAT(conn.LocalAddr(), 54321, time.Second); err != ErrNoRFC5780 {
+		t.Fatalf("got %v, want ErrNoRFC5780", err)
+	}
+}
+
+func TestClassifyMapping(t *testing.T) {
+	for _, test := range []struct {
+		nat  NATType
+		want NATType
+	}{
+		{NATFullCone, NATPortRestricted},
+		{NATPortRestricted, NATPortRestricted},
+		{NATSymmetric, NATSymmetric},
+	} {
+		network := NewMemNetwork(1)
+		var servers []net.Addr
+		for _, ip := range []net.IP{net.IPv4(198, 51, 100, 1), net.IPv4(198, 51, 100, 2)} {
+			conn, _ := network.Listen(&net.UDPAddr{IP: ip, Port: 3478}, nil)
+			defer conn.Close()
+			go ServeSTUN(conn)
+			servers = append(servers, conn.LocalAddr())
+		}
+		client := newMemSTUNClient(t, network, test.nat)
+		classified, err := client.ClassifyMapping(servers, 54321, time.Second)
+		if err != nil || classified != test.want {
+			t.Fatalf("%s: classified %s, %v, want %s", test.nat, classified, err, test.want)
+		}
+	}
+}
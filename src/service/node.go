@@ -2,59 +2,323 @@ package service
 
 import (
 	"bytes"
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"hash/crc32"
 	"net"
+	"strings"
 )
 
+// NodeStringScheme is the URI scheme prefix of node strings.
+const NodeStringScheme = "rumor://"
+
+// nodeStringVersion is the current node string version. Legacy base64 strings are regarded as version 1.
+const nodeStringVersion byte = 2
+
+// Field tags of node string v2. Unknown tags are skipped when decoding.
+const (
+	tagEndpoint byte = iota + 1
+	tagCapabilities
+)
+
+// Transport hints of an endpoint.
+const (
+	TransportUDP   byte = iota + 1
+	TransportXMPP       // Address is a JIDAddr used for signalling.
+	TransportRelay      // Address is a RelayAddr, dumped as the UDP address of the relay holding a slot for the node.
+)
+
+var nodeStringEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
 // Node defines a node containing necessary info about another node
 type Node struct {
 	ID *NodeID
 	// All nodes' address should be its public address for connection.
 	Address net.Addr
+	// Endpoints are extra addresses besides Address. They are only carried by node strings.
+	Endpoints []Endpoint
+	// Capabilities advertised by the node itself.
+	Capabilities Capabilities
+
+	responded bool // Whether the contact has responded to local node at Address, see Server.reIntroduce.
+}
+
+// Capabilities are what a node advertises about itself through pings and node strings.
+type Capabilities struct {
+	NAT        NATType
+	RelaySlots uint16 // Free relay slots, 0 if the node does not serve as a relay.
+}
+
+// Dumps dumps capabilities to byte slice.
+// | NAT type | Relay slots |
+// |    1     |      2      |
+func (caps *Capabilities) Dumps() []byte {
+	bytes := []byte{byte(caps.NAT), 0, 0}
+	binary.LittleEndian.PutUint16(bytes[1:], caps.RelaySlots)
+	return bytes
+}
+
+// Loads loads capabilities. Fields missing in older versions are left zero, extra bytes appended by newer versions are ignored.
+func (caps *Capabilities) Loads(bytes []byte) *Capabilities {
+	if len(bytes) < 1 {
+		return nil
+	}
+	caps.NAT = NATType(bytes[0])
+	caps.RelaySlots = 0
+	if len(bytes) >= 3 {
+		caps.RelaySlots = binary.LittleEndian.Uint16(bytes[1:3])
+	}
+	return caps
+}
+
+// Endpoint is an address with a hint of the transport used to reach it.
+type Endpoint struct {
+	Transport byte
+	Address   net.Addr
+}
+
+// RelayEndpoint returns the first relay endpoint of the node, nil if it has none.
+func (node *Node) RelayEndpoint() *RelayAddr {
+	for _, endpoint := range node.Endpoints {
+		if relayAddr, ok := endpoint.Address.(*RelayAddr); ok && endpoint.Transport == TransportRelay {
+			return relayAddr
+		}
+	}
+	return nil
 }
 
 func (node *Node) String() string {
 	return fmt.Sprintf("Node %x at %s", *node.ID, node.Address.String())
 }
 
-// DecodeString creates a node from a base64 string
+// DecodeString creates a node from a node string.
+// Both the rumor:// URI and the legacy base64 string are accepted. A malformed string is rejected with a *ParseError.
 func (node *Node) DecodeString(str string) error {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(strings.ToLower(str), NodeStringScheme) {
+		return node.decodeURI(str[len(NodeStringScheme):])
+	}
+	return node.decodeLegacyString(str)
+}
+
+func nodeStringError(field string, err error) error {
+	return &ParseError{"node string", field, err}
+}
+
+// decodeLegacyString creates a node from a legacy base64 string.
+func (node *Node) decodeLegacyString(str string) error {
 	byteArr, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
-		return err
+		return nodeStringError("base64", ErrEncoding)
 	}
 	// The byte array format:
-	// | NodeID 20bytes | IPv4 4bytes | port 2bytes|
-	if len(byteArr) != NodeIDLength+4+2 {
-		return errors.New("illegal code string")
+	// | NodeID 20bytes | IPv4 4bytes / IPv6 16bytes | port 2bytes|
+	if len(byteArr) != NodeIDLength+net.IPv4len+2 && len(byteArr) != NodeIDLength+net.IPv6len+2 {
+		return nodeStringError("length", ErrIllegal)
 	}
-	p := 0
 	var nodeID NodeID
-	copy(nodeID[:], byteArr[p:p+NodeIDLength])
-	p += NodeIDLength
+	copy(nodeID[:], byteArr[:NodeIDLength])
 	node.ID = &nodeID
+	node.Address = LoadUDPAddr(byteArr[NodeIDLength:])
+	node.Endpoints = nil
+	node.Capabilities = Capabilities{}
+	return nil
+}
+
+// decodeURI creates a node from the body of a rumor:// URI.
+// The body is base32 in any case, the byte array format:
+// | Version | NodeID | Fields | CRC32 of the former parts |
+// |    1    |   20   |   ...  |            4              |
+// Each field:
+// |  Tag  | Length | Value |
+// |   1   |   1    |  ...  |
+// An endpoint field holds | Transport 1byte | Address |. The first endpoint is the primary address.
+func (node *Node) decodeURI(body string) error {
+	byteArr, err := nodeStringEncoding.DecodeString(strings.ToUpper(body))
+	if err != nil {
+		return nodeStringError("base32", ErrEncoding)
+	}
+	if len(byteArr) < 1+NodeIDLength+4 {
+		return nodeStringError("header", ErrTruncated)
+	}
+	p := len(byteArr) - 4
+	if crc32.ChecksumIEEE(byteArr[:p]) != binary.BigEndian.Uint32(byteArr[p:]) {
+		return nodeStringError("checksum", ErrChecksum)
+	}
+	fields := byteArr[1+NodeIDLength : p]
+	// Newer versions may change the layout, thus only the current one is parsed.
+	if byteArr[0] != nodeStringVersion {
+		return nodeStringError(fmt.Sprintf("version %d", byteArr[0]), ErrVersion)
+	}
+
+	var nodeID NodeID
+	copy(nodeID[:], byteArr[1:1+NodeIDLength])
+	var endpoints []Endpoint
+	var caps Capabilities
+	for len(fields) > 0 {
+		if len(fields) < 2 || len(fields) < 2+int(fields[1]) {
+			return nodeStringError("field", ErrTruncated)
+		}
+		tag, value := fields[0], fields[2:2+int(fields[1])]
+		fields = fields[2+int(fields[1]):]
+		switch tag {
+		case tagEndpoint:
+			if len(value) < 1 {
+				return nodeStringError("endpoint", ErrTruncated)
+			}
+			addr := loadEndpointAddr(value[0], value[1:], &nodeID)
+			if addr == nil {
+				continue // Unknown transport, newer versions may understand it.
+			}
+			endpoints = append(endpoints, Endpoint{value[0], addr})
+		case tagCapabilities:
+			caps.Loads(value)
+		}
+	}
+	// The primary address is where datagrams are sent, which is either a UDP or a relayed one.
+	if len(endpoints) == 0 || endpoints[0].Transport != TransportUDP && endpoints[0].Transport != TransportRelay {
+		return nodeStringError("address", ErrIllegal)
+	}
 
-	ip := net.IPv4(byteArr[p], byteArr[p+1], byteArr[p+2], byteArr[p+3])
-	p += 4
-	port := int(binary.LittleEndian.Uint16(byteArr[p:]))
-	node.Address = &net.UDPAddr{IP: ip, Port: port}
+	node.ID = &nodeID
+	node.Address = endpoints[0].Address
+	node.Endpoints = endpoints[1:]
+	node.Capabilities = caps
 	return nil
 }
 
-// EncodeToString returns the string representation of the node
+// EncodeToString returns the string representation of the node, which is a rumor:// URI.
 func (node *Node) EncodeToString() string {
 	var buffer bytes.Buffer
+	buffer.WriteByte(nodeStringVersion)
 	buffer.Write((*node.ID)[:])
-	ip := node.Address.(*net.UDPAddr).IP.To4()
-	if ip == nil {
+	primary := Endpoint{TransportUDP, node.Address}
+	if _, isRelayed := node.Address.(*RelayAddr); isRelayed {
+		primary.Transport = TransportRelay
+	}
+	if !writeEndpointField(&buffer, primary) {
 		panic("error-the node has illegal ip")
 	}
-	buffer.Write(ip)
-	port := make([]byte, 2)
-	binary.LittleEndian.PutUint16(port, uint16(node.Address.(*net.UDPAddr).Port))
-	buffer.Write(port)
-	return base64.StdEncoding.EncodeToString(buffer.Bytes())
+	for _, endpoint := range node.Endpoints {
+		writeEndpointField(&buffer, endpoint)
+	}
+	caps := node.Capabilities.Dumps()
+	buffer.WriteByte(tagCapabilities)
+	buffer.WriteByte(byte(len(caps)))
+	buffer.Write(caps)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(buffer.Bytes()))
+	buffer.Write(checksum)
+	return NodeStringScheme + strings.ToLower(nodeStringEncoding.EncodeToString(buffer.Bytes()))
+}
+
+// writeEndpointField appends an endpoint field. Return false if the endpoint cannot be dumped.
+func writeEndpointField(buffer *bytes.Buffer, endpoint Endpoint) bool {
+	addr := dumpEndpointAddr(endpoint.Transport, endpoint.Address)
+	if addr == nil || len(addr) > 254 {
+		return false
+	}
+	buffer.WriteByte(tagEndpoint)
+	buffer.WriteByte(byte(len(addr) + 1))
+	buffer.WriteByte(endpoint.Transport)
+	buffer.Write(addr)
+	return true
+}
+
+// dumpEndpointAddr dumps an address according to its transport.
+func dumpEndpointAddr(transport byte, addr net.Addr) []byte {
+	if relayAddr, ok := addr.(*RelayAddr); ok && transport == TransportRelay {
+		addr = relayAddr.Relay
+	}
+	switch transport {
+	case TransportUDP, TransportRelay:
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			return nil
+		}
+		return DumpUDPAddr(udpAddr)
+	case TransportXMPP:
+		if jid, ok := addr.(JIDAddr); ok {
+			return []byte(jid)
+		}
+	}
+	return nil
+}
+
+// loadEndpointAddr loads an address of node id according to its transport. Return nil if unknown or illegal.
+func loadEndpointAddr(transport byte, bytes []byte, id *NodeID) net.Addr {
+	switch transport {
+	case TransportUDP:
+		if addr := LoadUDPAddr(bytes); addr != nil {
+			return addr
+		}
+	case TransportRelay:
+		if addr := LoadUDPAddr(bytes); addr != nil {
+			return &RelayAddr{addr, *id}
+		}
+	case TransportXMPP:
+		if len(bytes) > 0 {
+			return JIDAddr(bytes)
+		}
+	}
+	return nil
+}
+
+// Dumps dumps the node to byte slice as a contact for transmission.
+// | NodeID | Address length | Address(see DumpUDPAddr) |
+// |   20   |       1        |           6/18           |
+// A contact reached through a relay has the address of the relay prefixed with TransportRelay, thus 7/19 bytes.
+func (node *Node) Dumps() []byte {
+	var addr []byte
+	switch address := node.Address.(type) {
+	case *net.UDPAddr:
+		addr = DumpUDPAddr(address)
+	case *RelayAddr:
+		if relay, ok := address.Relay.(*net.UDPAddr); ok {
+			if dumped := DumpUDPAddr(relay); dumped != nil {
+				addr = append([]byte{TransportRelay}, dumped...)
+			}
+		}
+	}
+	if addr == nil {
+		return nil
+	}
+	buffer := make([]byte, NodeIDLength+1+len(addr))
+	copy(buffer, (*node.ID)[:])
+	buffer[NodeIDLength] = byte(len(addr))
+	copy(buffer[NodeIDLength+1:], addr)
+	return buffer
+}
+
+// Loads loads a contact dumped by Dumps from the head of a byte slice.
+// It returns the number of bytes consumed, so contacts could be loaded one after another.
+func (node *Node) Loads(bytes []byte) (int, error) {
+	if len(bytes) < NodeIDLength+1 {
+		return 0, &ParseError{"contact", "header", ErrTruncated}
+	}
+	addrLength := int(bytes[NodeIDLength])
+	total := NodeIDLength + 1 + addrLength
+	if len(bytes) < total {
+		return 0, &ParseError{"contact", "address", ErrTruncated}
+	}
+	id := new(NodeID)
+	copy((*id)[:], bytes[:NodeIDLength])
+	value := bytes[NodeIDLength+1 : total]
+	if addrLength%2 == 1 && value[0] == TransportRelay {
+		relay := LoadUDPAddr(value[1:])
+		if relay == nil {
+			return 0, &ParseError{"contact", "relay address", ErrIllegal}
+		}
+		node.ID, node.Address = id, &RelayAddr{relay, *id}
+		return total, nil
+	}
+	addr := LoadUDPAddr(value)
+	if addr == nil {
+		return 0, &ParseError{"contact", "address", ErrIllegal}
+	}
+	node.ID = id
+	node.Address = addr
+	return total, nil
 }
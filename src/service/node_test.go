@@ -0,0 +1,132 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRelayedNodeString(t *testing.T) {
+	id := NewRandNodeID()
+	relay := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 54321}
+	node := &Node{ID: id, Address: &RelayAddr{relay, *id}, Endpoints: []Endpoint{{TransportRelay, &RelayAddr{relay, *id}}}}
+	var decoded Node
+	if err := decoded.DecodeString(node.EncodeToString()); err != nil {
+		t.Fatal(err)
+	}
+	if !SameAddr(decoded.Address, node.Address) {
+		t.Fatalf("decoded address %s, want %s", decoded.Address, node.Address)
+	}
+	if relayAddr := decoded.RelayEndpoint(); relayAddr == nil || relayAddr.Target != *id || !SameAddr(relayAddr.Relay, relay) {
+		t.Fatalf("decoded relay endpoint %v", relayAddr)
+	}
+}
+
+func TestRelayedContact(t *testing.T) {
+	id := NewRandNodeID()
+	node := &Node{ID: id, Address: &RelayAddr{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321}, *id}}
+	bytes := node.Dumps()
+	if bytes == nil {
+		t.Fatal("relayed contact is not dumped")
+	}
+	var loaded Node
+	if n, err := loaded.Loads(bytes); err != nil || n != len(bytes) {
+		t.Fatalf("loaded %d of %d bytes: %v", n, len(bytes), err)
+	}
+	if *loaded.ID != *id || !SameAddr(loaded.Address, node.Address) {
+		t.Fatalf("loaded %s, want %s", &loaded, node)
+	}
+}
+
+func TestAddNodeThroughRelay(t *testing.T) {
+	network := NewMemNetwork(1)
+	relay := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	relay.EnableRelay(4, 64*1024)
+	nat, _ := network.NewNAT(NATSymmetric, net.IPv4(203, 0, 113, 1), 0)
+	client := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nat)
+	if err := client.ReserveRelay(relay.KBuckets.SelfNode()); err != nil {
+		t.Fatal(err)
+	}
+	a := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+
+	var node Node
+	if err := node.DecodeString(client.KBuckets.SelfNode().EncodeToString()); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddNode(&node); err != nil {
+		t.Fatal(err)
+	}
+	added := a.KBuckets.Get(node.ID)
+	if added == nil {
+		t.Fatal("node is not added")
+	}
+	if _, isRelayed := added.Address.(*RelayAddr); !isRelayed || len(added.Endpoints) == 0 {
+		t.Fatalf("node added at %s with endpoints %v, want the relay", added.Address, added.Endpoints)
+	}
+	if !a.Ping(&Node{ID: node.ID, Address: added.Address}) {
+		t.Fatal("relayed node did not respond")
+	}
+}
+
+// nodeStringOf encodes a node string of endpoints without checking them, the first one being the primary address.
+func nodeStringOf(id *NodeID, endpoints ...Endpoint) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte(nodeStringVersion)
+	buffer.Write(id[:])
+	for _, endpoint := range endpoints {
+		writeEndpointField(&buffer, endpoint)
+	}
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(buffer.Bytes()))
+	buffer.Write(checksum)
+	return NodeStringScheme + strings.ToLower(nodeStringEncoding.EncodeToString(buffer.Bytes()))
+}
+
+func TestNodeStringPrimaryTransport(t *testing.T) {
+	id := NewRandNodeID()
+	udpAddr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 54321}
+	// Datagrams cannot be sent to a JID, thus it is only taken as a further endpoint.
+	node := Node{Capabilities: Capabilities{NAT: NATFullCone}}
+	err := node.DecodeString(nodeStringOf(id, Endpoint{TransportXMPP, JIDAddr("alice@localhost")}, Endpoint{TransportUDP, udpAddr}))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || !errors.Is(err, ErrIllegal) {
+		t.Fatalf("decoded a jid as the primary address: %v", err)
+	}
+	if node.ID != nil || node.Capabilities.NAT != NATFullCone {
+		t.Fatal("rejected string is partly decoded")
+	}
+	if err := node.DecodeString(nodeStringOf(id, Endpoint{TransportUDP, udpAddr}, Endpoint{TransportXMPP, JIDAddr("alice@localhost")})); err != nil {
+		t.Fatal(err)
+	}
+	if !SameAddr(node.Address, udpAddr) || len(node.Endpoints) != 1 {
+		t.Fatalf("decoded %s with endpoints %v", node.Address, node.Endpoints)
+	}
+}
+
+func FuzzNodeDecodeString(f *testing.F) {
+	id := NewRandNodeID()
+	relay := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1).To4(), Port: 54321}
+	f.Add((&Node{ID: id, Address: relay}).EncodeToString())
+	f.Add((&Node{ID: id, Address: &RelayAddr{relay, *id}, Endpoints: []Endpoint{{TransportRelay, &RelayAddr{relay, *id}}}}).EncodeToString())
+	f.Add((&Node{ID: id, Address: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321}}).EncodeToString())
+	f.Add(nodeStringOf(id, Endpoint{TransportXMPP, JIDAddr("alice@localhost")}))
+
+	f.Fuzz(func(t *testing.T, str string) {
+		var node Node
+		if node.DecodeString(str) != nil {
+			return
+		}
+		// What decodes is encoded into what decodes the same.
+		var again Node
+		if err := again.DecodeString(node.EncodeToString()); err != nil {
+			t.Fatalf("encoded node does not decode: %s", err)
+		}
+		if *again.ID != *node.ID || !SameAddr(again.Address, node.Address) {
+			t.Fatalf("decoded %s at %s, want %s at %s", again.ID, again.Address, node.ID, node.Address)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DataObserved wraps a response payload with the requester's address observed by the responder.
+// | Observed address, tagObserved | Response payload fields |
+// The address is absent if it is not a UDP one, e.g. a relayed requester.
+type DataObserved struct {
+	Observed *net.UDPAddr
+	Payload  Payload
+}
+
+// NewObserved wraps a response payload.
+func NewObserved(observed net.Addr, payload Payload) *DataObserved {
+	udpAddr, _ := observed.(*net.UDPAddr)
+	return &DataObserved{udpAddr, payload}
+}
+
+// Encode encodes the observed address followed by the response payload.
+func (observed *DataObserved) Encode(encoder *Encoder) {
+	if observed.Observed != nil {
+		encoder.Addr(tagObserved, observed.Observed)
+	}
+	observed.Payload.Encode(encoder)
+}
+
+// Decode decodes the observed address only, fields of the response payload are skipped.
+func (observed *DataObserved) Decode(decoder *Decoder, isReq bool) error {
+	for decoder.Next() {
+	}
+	observed.Observed = decoder.Observed()
+	return decoder.Err()
+}
+
+// observation is an address reported by a peer.
+type observation struct {
+	addr     *net.UDPAddr
+	reporter net.IP
+	time     time.Time
+}
+
+// Observations gathers local node's addresses observed by peers.
+type Observations struct {
+	reports map[NodeID]observation
+	lock    *sync.Mutex
+}
+
+// NewObservations creates an empty observation set.
+func NewObservations() *Observations {
+	return &Observations{make(map[NodeID]observation), &sync.Mutex{}}
+}
+
+// add records an observation and returns the address agreed by at least quorum reporters from distinct IPs, or nil.
+// Observations older than lifetime are dropped as of now.
+func (observations *Observations) add(reporter *NodeID, reporterIP net.IP, addr *net.UDPAddr, quorum int, lifetime time.Duration, now time.Time) *net.UDPAddr {
+	observations.lock.Lock()
+	defer observations.lock.Unlock()
+	observations.reports[*reporter] = observation{addr, reporterIP, now}
+
+	var agreed []net.IP
+	for id, report := range observations.reports {
+		if now.Sub(report.time) > lifetime {
+			delete(observations.reports, id)
+			continue
+		}
+		if !SameAddr(report.addr, addr) {
+			continue
+		}
+		independent := true
+		for _, ip := range agreed {
+			independent = independent && !ip.Equal(report.reporter)
+		}
+		if independent {
+			agreed = append(agreed, report.reporter)
+		}
+	}
+	if len(agreed) < quorum {
+		return nil
+	}
+	return addr
+}
+
+// reporterIP returns the IP of a reporter whose observations count, or nil.
+// Only public reporters count, since peers in the same LAN see a private address.
+func reporterIP(reporter net.Addr) net.IP {
+	udpAddr, ok := reporter.(*net.UDPAddr)
+	if !ok || !udpAddr.IP.IsGlobalUnicast() || udpAddr.IP.IsPrivate() {
+		return nil
+	}
+	return udpAddr.IP
+}
+
+// observe records the observed address of a response.
+func (server *Server) observe(datagram *Datagram) {
+	addr := datagram.Observed
+	if addr == nil {
+		return
+	}
+	reporter := reporterIP(datagram.SourceNode.Address)
+	if reporter == nil {
+		return
+	}
+	agreed := server.observed.add(datagram.SourceNode.ID, reporter, addr, server.config.ObservationQuorum,
+		time.Duration(server.config.ObservationLifetime)*time.Second, server.Clock.Now())
+	// A mapped port is preferred since it is reachable without keepalives.
+	if agreed == nil {
+		return
+	}
+	changed := false
+	server.KBuckets.updateSelf(func(self *Node) {
+		if server.portMapping == nil && !SameAddr(agreed, self.Address) {
+			self.Address, changed = agreed, true
+		}
+	})
+	if changed {
+		log.Println("Public address agreed by peers: ", agreed)
+	}
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestObservationsAdd(t *testing.T) {
+	// A report is by the nth reporter from a reporter address, of the observed address, some seconds after the start.
+	type report struct {
+		reporter int
+		from     string
+		observed string
+		at       int
+	}
+	tests := []struct {
+		name    string
+		reports []report
+		agreed  string
+	}{
+		{"single report", []report{{0, "198.51.100.1", "203.0.113.1:1000", 0}}, ""},
+		{"quorum", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "198.51.100.2", "203.0.113.1:1000", 1},
+		}, "203.0.113.1:1000"},
+		{"disagreement", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "198.51.100.2", "203.0.113.1:2000", 1},
+		}, ""},
+		{"reporters sharing an IP", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "198.51.100.1", "203.0.113.1:1000", 1},
+		}, ""},
+		{"reporter repeating itself", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{0, "198.51.100.1", "203.0.113.1:1000", 1},
+		}, ""},
+		{"reporter changing its mind", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{0, "198.51.100.1", "203.0.113.1:2000", 1},
+			{1, "198.51.100.2", "203.0.113.1:1000", 2},
+		}, ""},
+		{"expired report", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "198.51.100.2", "203.0.113.1:1000", 61},
+		}, ""},
+		{"report within lifetime", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "198.51.100.2", "203.0.113.1:1000", 60},
+		}, "203.0.113.1:1000"},
+		{"private reporter", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "192.168.0.1", "203.0.113.1:1000", 1},
+		}, ""},
+		{"loopback reporter", []report{
+			{0, "198.51.100.1", "203.0.113.1:1000", 0},
+			{1, "127.0.0.1", "203.0.113.1:1000", 1},
+		}, ""},
+	}
+	start := time.Unix(0, 0)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			observations := NewObservations()
+			reporters := []*NodeID{NewRandNodeID(), NewRandNodeID()}
+			var agreed *net.UDPAddr
+			for _, r := range test.reports {
+				// Reports are filtered by their reporter as server.observe does.
+				ip := reporterIP(&net.UDPAddr{IP: net.ParseIP(r.from), Port: 54321})
+				if ip == nil {
+					continue
+				}
+				observed, _ := net.ResolveUDPAddr("udp", r.observed)
+				agreed = observations.add(reporters[r.reporter], ip, observed, 2, time.Minute, start.Add(time.Duration(r.at)*time.Second))
+			}
+			if got := addrString(agreed); got != test.agreed {
+				t.Fatalf("agreed on %q, want %q", got, test.agreed)
+			}
+		})
+	}
+}
+
+// addrString formats addr, empty if nil.
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+/*
+Parsing:
+Packets and node strings come from anyone, thus they are checked in full before anything else sees them.
+A datagram is rejected unless its type is known and its payload decodes as its type and direction, see codec.go.
+The decoded payload is kept in the datagram for handlers, see Datagram.Data.
+Rejections are *ParseError, which wrap one of the Err values below for errors.Is, and malformed packets are
+counted per source, see Malformed.
+*/
+
+// Reasons of parse errors.
+var (
+	ErrTruncated   = errors.New("truncated")
+	ErrMissing     = errors.New("missing")
+	ErrTooLarge    = errors.New("too large")
+	ErrUnknownType = errors.New("unknown message type")
+	ErrIllegal     = errors.New("illegal value")
+	ErrEncoding    = errors.New("illegal encoding")
+	ErrChecksum    = errors.New("checksum mismatch")
+	ErrVersion     = errors.New("unsupported version")
+)
+
+// ParseError tells which part of an input is malformed and why.
+type ParseError struct {
+	Input string // What is parsed, e.g. "datagram" or "node string".
+	Field string // The malformed part.
+	Err   error  // One of the reasons above.
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("malformed %s, %s: %s", err.Input, err.Field, err.Err)
+}
+
+// Unwrap returns the reason.
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+func datagramError(field string, err error) error {
+	return &ParseError{"datagram", field, err}
+}
+
+// validType tells whether a message type is known.
+func validType(msgType byte) bool {
+	return newPayload(msgType) != nil
+}
+
+// newPayload returns an empty payload of a message type to decode into, nil if the type is unknown.
+func newPayload(msgType byte) Payload {
+	switch msgType {
+	case Ping:
+		return &DataPing{}
+	case Connect:
+		return &DataConnect{}
+	case Introduce:
+		return &DataIntroduce{}
+	case RelayReserve:
+		return &DataRelayReserve{}
+	case RelayData:
+		return &DataRelay{}
+	case Probe:
+		return &DataProbe{}
+	case FindNode:
+		return &DataFindNode{}
+	}
+	return nil
+}
+
+// decodePayload decodes a payload as its message type and direction, which checks it against the schema.
+// The observed address is returned as well, see DataObserved.
+func decodePayload(msgType byte, isReq bool, payload []byte) (Payload, *net.UDPAddr, error) {
+	data := newPayload(msgType)
+	decoder := NewDecoder(payload)
+	if err := data.Decode(decoder, isReq); err != nil {
+		return nil, nil, err
+	}
+	return data, decoder.Observed(), nil
+}
+
+// maxMalformedSources bounds the sources tracked by Malformed, since source addresses could be forged at will.
+// Packets from further sources are only counted in the total.
+const maxMalformedSources = 1024
+
+// Malformed counts malformed packets per source IP.
+type Malformed struct {
+	total   uint64
+	sources map[string]*MalformedSource
+	lock    sync.Mutex
+}
+
+// MalformedSource is the count of malformed packets from a source, with the reason of the last one.
+type MalformedSource struct {
+	Source    string
+	Count     uint64
+	LastError string
+}
+
+// NewMalformed creates an empty counter.
+func NewMalformed() *Malformed {
+	return &Malformed{sources: make(map[string]*MalformedSource)}
+}
+
+// add counts a malformed packet from addr.
+func (malformed *Malformed) add(addr net.Addr, err error) {
+	source := "unknown"
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		source = addr.IP.String()
+	case nil:
+	default:
+		source = addr.String()
+	}
+	malformed.lock.Lock()
+	defer malformed.lock.Unlock()
+	malformed.total++
+	entry, isExist := malformed.sources[source]
+	if !isExist {
+		if len(malformed.sources) >= maxMalformedSources {
+			return
+		}
+		entry = &MalformedSource{Source: source}
+		malformed.sources[source] = entry
+	}
+	entry.Count++
+	entry.LastError = err.Error()
+}
+
+// Stats returns the total count and the counts per source, the most first.
+func (malformed *Malformed) Stats() (uint64, []MalformedSource) {
+	malformed.lock.Lock()
+	defer malformed.lock.Unlock()
+	sources := make([]MalformedSource, 0, len(malformed.sources))
+	for _, entry := range malformed.sources {
+		sources = append(sources, *entry)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Count > sources[j].Count
+	})
+	return malformed.total, sources
+}
@@ -0,0 +1,70 @@
+package service
+
+import "sync"
+
+/*
+Pooling:
+Buffers and datagrams in the hot path are taken from pools instead of being allocated per packet.
+
+Ownership rules:
+- A buffer from GetBuffer is owned by the caller until PutBuffer. Nothing may refer to it afterwards.
+- A datagram from AcquireDatagram, together with its cookie, source node and NodeID, is owned by whoever it is
+  handed to. The owner calls Release once done, or simply drops it if it is retained, e.g. a response returned
+  by Server.request. Dropped ones are collected as usual.
+- A datagram loaded by LoadsView refers to the loaded bytes. The read loop hands the buffer over to the datagram,
+  which puts it back on Release. Request handlers must not retain a datagram or its payload after returning,
+  see Server.requestHandler.
+*/
+
+var bufferPool = sync.Pool{New: func() interface{} {
+	return new([MaxPackageSize]byte)
+}}
+
+var datagramPool = sync.Pool{New: func() interface{} {
+	return new(Datagram)
+}}
+
+// GetBuffer returns a buffer of MaxPackageSize bytes.
+func GetBuffer() []byte {
+	return bufferPool.Get().(*[MaxPackageSize]byte)[:]
+}
+
+// PutBuffer puts a buffer back. Buffers of other sizes are dropped.
+func PutBuffer(buffer []byte) {
+	if cap(buffer) != MaxPackageSize {
+		return
+	}
+	bufferPool.Put((*[MaxPackageSize]byte)(buffer[:MaxPackageSize]))
+}
+
+// AcquireDatagram returns an empty datagram.
+func AcquireDatagram() *Datagram {
+	return datagramPool.Get().(*Datagram)
+}
+
+// Release puts the datagram and the buffer it owns back. The datagram must not be used afterwards.
+func (datagram *Datagram) Release() {
+	if datagram.buffer != nil {
+		PutBuffer(datagram.buffer)
+	}
+	payload := datagram.payload[:0]
+	*datagram = Datagram{}
+	datagram.payload = payload
+	datagramPool.Put(datagram)
+}
+
+// Clone returns a pooled copy of the datagram, which owns its payload. Data and Observed are left out since they
+// refer to the original payload, decode the copy if needed.
+func (datagram *Datagram) Clone() *Datagram {
+	clone := AcquireDatagram()
+	clone.Type, clone.IsRequest, clone.Timestamp = datagram.Type, datagram.IsRequest, datagram.Timestamp
+	clone.Compressed, clone.AcceptsCompressed = datagram.Compressed, datagram.AcceptsCompressed
+	clone.cookie = *datagram.MagicCookie
+	clone.MagicCookie = &clone.cookie
+	clone.id = *datagram.SourceNode.ID
+	clone.node = Node{ID: &clone.id, Address: datagram.SourceNode.Address}
+	clone.SourceNode = &clone.node
+	clone.payload = append(clone.payload[:0], datagram.Payload...)
+	clone.Payload = clone.payload
+	return clone
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PortMapper asks a gateway to forward an external UDP port to a local port.
+type PortMapper interface {
+	Name() string
+	// AddMapping creates or renews a mapping, returns the external address and the granted lifetime.
+	AddMapping(localPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error)
+	// DeleteMapping removes the mapping of a local port.
+	DeleteMapping(localPort int) error
+}
+
+// gatewayPort is the port of NAT-PMP and PCP servers.
+const gatewayPort int = 5351
+
+// DefaultGateway finds the IPv4 default gateway from the routing table. Only Linux is supported yet.
+func DefaultGateway() (net.IP, error) {
+	fd, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := hex.DecodeString(fields[2])
+		if err != nil || len(gateway) != 4 {
+			continue
+		}
+		// Stored in little endian.
+		return net.IPv4(gateway[3], gateway[2], gateway[1], gateway[0]), nil
+	}
+	return nil, errors.New("no default gateway found")
+}
+
+// DefaultPortMappers returns mappers in preferred order: PCP, NAT-PMP, UPnP IGD.
+// timeout applies to every request of them.
+func DefaultPortMappers(timeout time.Duration) []PortMapper {
+	mappers := []PortMapper{}
+	if gateway, err := DefaultGateway(); err == nil {
+		gatewayAddr := &net.UDPAddr{IP: gateway, Port: gatewayPort}
+		mappers = append(mappers, &PCPMapper{Gateway: gatewayAddr, Timeout: timeout}, &NATPMPMapper{Gateway: gatewayAddr, Timeout: timeout})
+	}
+	return append(mappers, &UPnPMapper{Timeout: timeout})
+}
+
+// gatewayRoundTrip sends a request to a gateway and waits for a response accepted by valid.
+// Requests are retransmitted with doubling intervals starting at 250ms until timeout.
+func gatewayRoundTrip(gateway *net.UDPAddr, req []byte, timeout time.Duration, valid func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 1100)
+	for rto := 250 * time.Millisecond; time.Now().Before(deadline); rto *= 2 {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(rto)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			if valid(buffer[:n]) {
+				return buffer[:n], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("gateway %s timed out", gateway)
+}
+
+// NATPMPMapper maps ports by NAT-PMP, see RFC 6886.
+type NATPMPMapper struct {
+	Gateway *net.UDPAddr
+	Timeout time.Duration // Timeout of every request.
+}
+
+// Name returns the protocol name.
+func (mapper *NATPMPMapper) Name() string {
+	return "NAT-PMP"
+}
+
+// AddMapping creates or renews a UDP mapping.
+func (mapper *NATPMPMapper) AddMapping(localPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	// External address request: | Version 0 | Opcode 0 |
+	res, err := gatewayRoundTrip(mapper.Gateway, []byte{0, 0}, mapper.Timeout, func(res []byte) bool {
+		return len(res) >= 12 && res[0] == 0 && res[1] == 128
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+		return nil, 0, fmt.Errorf("nat-pmp error code %d", code)
+	}
+	ip := net.IPv4(res[8], res[9], res[10], res[11])
+
+	port, granted, err := mapper.mapUDP(localPort, localPort, lifetime)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, granted, nil
+}
+
+// DeleteMapping removes a UDP mapping by requesting zero lifetime.
+func (mapper *NATPMPMapper) DeleteMapping(localPort int) error {
+	_, _, err := mapper.mapUDP(localPort, 0, 0)
+	return err
+}
+
+// mapUDP sends a map UDP request.
+// Request:  | Version 0 | Opcode 1 | Reserved 2 | Internal port 2 | External port 2 | Lifetime 4 |
+// Response: | Version 0 | Opcode 129 | Result 2 | Epoch 4 | Internal port 2 | External port 2 | Lifetime 4 |
+func (mapper *NATPMPMapper) mapUDP(localPort, externalPort int, lifetime time.Duration) (int, time.Duration, error) {
+	req := make([]byte, 12)
+	req[1] = 1
+	binary.BigEndian.PutUint16(req[4:6], uint16(localPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	res, err := gatewayRoundTrip(mapper.Gateway, req, mapper.Timeout, func(res []byte) bool {
+		return len(res) >= 16 && res[0] == 0 && res[1] == 129 && int(binary.BigEndian.Uint16(res[8:10])) == localPort
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+		return 0, 0, fmt.Errorf("nat-pmp error code %d", code)
+	}
+	return int(binary.BigEndian.Uint16(res[10:12])), time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second, nil
+}
+
+// PCPMapper maps ports by PCP, see RFC 6887.
+type PCPMapper struct {
+	Gateway *net.UDPAddr
+	Timeout time.Duration // Timeout of every request.
+	nonce   [12]byte
+}
+
+// Name returns the protocol name.
+func (mapper *PCPMapper) Name() string {
+	return "PCP"
+}
+
+// AddMapping creates or renews a UDP mapping.
+func (mapper *PCPMapper) AddMapping(localPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	// The same nonce must be used to renew or delete a mapping.
+	if mapper.nonce == [12]byte{} {
+		if _, err := rand.Read(mapper.nonce[:]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return mapper.mapUDP(localPort, lifetime)
+}
+
+// DeleteMapping removes a UDP mapping by requesting zero lifetime.
+func (mapper *PCPMapper) DeleteMapping(localPort int) error {
+	_, _, err := mapper.mapUDP(localPort, 0)
+	return err
+}
+
+// mapUDP sends a MAP request.
+// Request header:  | Version 2 | Opcode 1 | Reserved 2 | Lifetime 4 | Client IP 16 |
+// Response header: | Version 2 | Opcode 0x81 | Reserved 1 | Result 1 | Lifetime 4 | Epoch 4 | Reserved 12 |
+// MAP payload:     | Nonce 12 | Protocol 1 | Reserved 3 | Internal port 2 | External port 2 | External IP 16 |
+func (mapper *PCPMapper) mapUDP(localPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	// The client IP must be the source address the gateway sees.
+	probe, err := net.DialUDP("udp", nil, mapper.Gateway)
+	if err != nil {
+		return nil, 0, err
+	}
+	clientIP := probe.LocalAddr().(*net.UDPAddr).IP.To16()
+	probe.Close()
+
+	req := make([]byte, 60)
+	req[0], req[1] = 2, 1
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], clientIP)
+	copy(req[24:36], mapper.nonce[:])
+	req[36] = 17 // UDP
+	binary.BigEndian.PutUint16(req[40:42], uint16(localPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(localPort))
+	copy(req[44:60], net.IPv4zero.To16())
+	res, err := gatewayRoundTrip(mapper.Gateway, req, mapper.Timeout, func(res []byte) bool {
+		return len(res) >= 24 && res[0] == 2 && res[1] == 0x81 && (res[3] != 0 || len(res) >= 60 && string(res[24:36]) == string(mapper.nonce[:]))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if res[3] != 0 {
+		return nil, 0, fmt.Errorf("pcp result code %d", res[3])
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, res[44:60])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(res[42:44]))}, time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second, nil
+}
+
+// PortMapping keeps a port mapped on the gateway, renewing it before expiry.
+// The mapping of a server and its External are guarded by the tree lock, since they change together with Self.Address.
+type PortMapping struct {
+	Mapper    PortMapper
+	External  *net.UDPAddr
+	localPort int
+	stop      chan struct{}
+	wg        *sync.WaitGroup
+}
+
+// MapPort tries mappers in order until one of them maps the listening port.
+// The external address is advertised as Self.Address and the mapping is renewed at half its lifetime.
+func (server *Server) MapPort(mappers []PortMapper) (*PortMapping, error) {
+	localAddr, ok := server.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, errors.New("local address is not a udp address")
+	}
+	lifetime := time.Duration(server.config.PortMappingLifetime) * time.Second
+	lastErr := errors.New("no port mapper available")
+	for _, mapper := range mappers {
+		external, granted, err := mapper.AddMapping(localAddr.Port, lifetime)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", mapper.Name(), err)
+			continue
+		}
+		mapping := &PortMapping{mapper, external, localAddr.Port, make(chan struct{}), &sync.WaitGroup{}}
+		server.KBuckets.updateSelf(func(self *Node) {
+			self.Address = external
+			server.portMapping = mapping
+		})
+		log.Printf("Port mapped by %s: %s\n", mapper.Name(), external)
+		mapping.wg.Add(1)
+		go server.renewPortMapping(mapping, granted)
+		return mapping, nil
+	}
+	return nil, lastErr
+}
+
+// renewPortMapping renews a mapping at half of its lifetime until unmapped.
+func (server *Server) renewPortMapping(mapping *PortMapping, granted time.Duration) {
+	defer mapping.wg.Done()
+	lifetime := time.Duration(server.config.PortMappingLifetime) * time.Second
+	for {
+		wait := granted / 2
+		if wait < time.Second {
+			wait = time.Second
+		}
+		elapsed, timer := after(server.Clock, wait)
+		select {
+		case <-mapping.stop:
+			timer.Stop()
+			return
+		case <-elapsed:
+		}
+		external, newGranted, err := mapping.Mapper.AddMapping(mapping.localPort, lifetime)
+		if err != nil {
+			log.Printf("failed to renew port mapping: %s\n", err)
+			granted = wait // Retry sooner before the old one expires.
+			continue
+		}
+		granted = newGranted
+		// Only this goroutine writes External, thus reading it without the lock is safe.
+		if !SameAddr(external, mapping.External) {
+			server.KBuckets.updateSelf(func(self *Node) {
+				mapping.External = external
+				self.Address = external
+			})
+			log.Printf("Mapped port changed: %s\n", external)
+		}
+	}
+}
+
+// UnmapPort stops renewing and removes the mapping from the gateway.
+func (server *Server) UnmapPort() error {
+	var mapping *PortMapping
+	server.KBuckets.updateSelf(func(*Node) {
+		mapping, server.portMapping = server.portMapping, nil
+	})
+	if mapping == nil {
+		return nil
+	}
+	close(mapping.stop)
+	mapping.wg.Wait()
+	return mapping.Mapper.DeleteMapping(mapping.localPort)
+}
+
+// mappedAddr returns the external address of the port mapping, nil if the port is not mapped.
+func (server *Server) mappedAddr() *net.UDPAddr {
+	server.KBuckets.lock.Lock()
+	defer server.KBuckets.lock.Unlock()
+	if server.portMapping == nil {
+		return nil
+	}
+	return server.portMapping.External
+}
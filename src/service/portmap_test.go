@@ -0,0 +1,207 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway serves PCP and NAT-PMP on loopback, mapping every internal port to external port + 1000.
+type fakeGateway struct {
+	conn     net.PacketConn
+	pcp      bool // Whether PCP is spoken, otherwise PCP requests are ignored.
+	external net.IP
+	lifetime time.Duration // Granted lifetime, at most the requested one.
+	mappings map[int]time.Duration
+	lock     *sync.Mutex
+}
+
+// newFakeGateway starts a gateway granting at most lifetime, which is closed once the test ends.
+func newFakeGateway(t *testing.T, pcp bool, lifetime time.Duration) *fakeGateway {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	gateway := &fakeGateway{conn, pcp, net.IPv4(203, 0, 113, 1).To4(), lifetime, make(map[int]time.Duration), &sync.Mutex{}}
+	go gateway.serve()
+	return gateway
+}
+
+func (gateway *fakeGateway) addr() *net.UDPAddr {
+	return gateway.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (gateway *fakeGateway) setExternal(ip net.IP) {
+	gateway.lock.Lock()
+	gateway.external = ip.To4()
+	gateway.lock.Unlock()
+}
+
+func (gateway *fakeGateway) mapped(port int) bool {
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	_, isExist := gateway.mappings[port]
+	return isExist
+}
+
+// grant records a mapping request and returns the external port, the granted lifetime and the external ip.
+func (gateway *fakeGateway) grant(port int, lifetime time.Duration) (int, time.Duration, net.IP) {
+	gateway.lock.Lock()
+	defer gateway.lock.Unlock()
+	if lifetime == 0 {
+		delete(gateway.mappings, port)
+		return 0, 0, gateway.external
+	}
+	if lifetime > gateway.lifetime {
+		lifetime = gateway.lifetime
+	}
+	gateway.mappings[port] = lifetime
+	return port + 1000, lifetime, gateway.external
+}
+
+func (gateway *fakeGateway) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, addr, err := gateway.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		req := buffer[:n]
+		switch {
+		case n == 2 && req[0] == 0 && req[1] == 0:
+			res := make([]byte, 12)
+			res[1] = 128
+			gateway.lock.Lock()
+			copy(res[8:12], gateway.external)
+			gateway.lock.Unlock()
+			gateway.conn.WriteTo(res, addr)
+		case n == 12 && req[0] == 0 && req[1] == 1:
+			internal := int(binary.BigEndian.Uint16(req[4:6]))
+			port, lifetime, _ := gateway.grant(internal, time.Duration(binary.BigEndian.Uint32(req[8:12]))*time.Second)
+			res := make([]byte, 16)
+			res[1] = 129
+			binary.BigEndian.PutUint16(res[8:10], uint16(internal))
+			binary.BigEndian.PutUint16(res[10:12], uint16(port))
+			binary.BigEndian.PutUint32(res[12:16], uint32(lifetime/time.Second))
+			gateway.conn.WriteTo(res, addr)
+		case n == 60 && req[0] == 2 && req[1] == 1 && gateway.pcp:
+			internal := int(binary.BigEndian.Uint16(req[40:42]))
+			port, lifetime, ip := gateway.grant(internal, time.Duration(binary.BigEndian.Uint32(req[4:8]))*time.Second)
+			res := make([]byte, 60)
+			res[0], res[1] = 2, 0x81
+			binary.BigEndian.PutUint32(res[4:8], uint32(lifetime/time.Second))
+			copy(res[24:40], req[24:40]) // Nonce and protocol.
+			binary.BigEndian.PutUint16(res[40:42], uint16(internal))
+			binary.BigEndian.PutUint16(res[42:44], uint16(port))
+			copy(res[44:60], ip.To16())
+			gateway.conn.WriteTo(res, addr)
+		}
+	}
+}
+
+// newFakeIGD serves a UPnP IGD description and its WANIPConnection control on loopback.
+func newFakeIGD(t *testing.T, external string) (*httptest.Server, map[string]bool) {
+	mappings := make(map[string]bool)
+	lock := &sync.Mutex{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device><deviceList><device><serviceList><service>`+
+			`<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl</controlURL>`+
+			`</service></serviceList></device></deviceList></device></root>`)
+	})
+	mux.HandleFunc("/ctl", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case strings.HasSuffix(action, `#AddPortMapping"`):
+			mappings[xmlElementText(body, "NewExternalPort")] = true
+		case strings.HasSuffix(action, `#DeletePortMapping"`):
+			delete(mappings, xmlElementText(body, "NewExternalPort"))
+		case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+			fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+				`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+				`<NewExternalIPAddress>%s</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, external)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, mappings
+}
+
+func TestPortMappers(t *testing.T) {
+	gateway := newFakeGateway(t, true, time.Hour)
+	for _, mapper := range []PortMapper{
+		&PCPMapper{Gateway: gateway.addr(), Timeout: time.Second},
+		&NATPMPMapper{Gateway: gateway.addr(), Timeout: time.Second},
+	} {
+		external, granted, err := mapper.AddMapping(54321, 2*time.Hour)
+		if err != nil {
+			t.Fatalf("%s: %s", mapper.Name(), err)
+		}
+		if !external.IP.Equal(gateway.external) || external.Port != 55321 || granted != time.Hour {
+			t.Fatalf("%s: mapped %s for %s", mapper.Name(), external, granted)
+		}
+		if err = mapper.DeleteMapping(54321); err != nil || gateway.mapped(54321) {
+			t.Fatalf("%s: mapping is not deleted: %v", mapper.Name(), err)
+		}
+	}
+}
+
+func TestUPnPMapper(t *testing.T) {
+	igd, mappings := newFakeIGD(t, "203.0.113.1")
+	mapper := &UPnPMapper{Location: igd.URL + "/desc.xml", Timeout: time.Second}
+	external, _, err := mapper.AddMapping(54321, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if external.String() != "203.0.113.1:54321" || !mappings["54321"] {
+		t.Fatalf("mapped %s, gateway holds %v", external, mappings)
+	}
+	if err = mapper.DeleteMapping(54321); err != nil || mappings["54321"] {
+		t.Fatalf("mapping is not deleted: %v", err)
+	}
+}
+
+func TestMapPort(t *testing.T) {
+	// The gateway only speaks NAT-PMP, PCP is given up after its timeout.
+	gateway := newFakeGateway(t, false, 2*time.Second)
+	server := newMemServer(t, NewMemNetwork(1), &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nil)
+	mapping, err := server.MapPort([]PortMapper{
+		&PCPMapper{Gateway: gateway.addr(), Timeout: 300 * time.Millisecond},
+		&NATPMPMapper{Gateway: gateway.addr(), Timeout: time.Second},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.Mapper.Name() != "NAT-PMP" || !SameAddr(server.KBuckets.SelfNode().Address, mapping.External) {
+		t.Fatalf("mapped %s by %s, self at %s", mapping.External, mapping.Mapper.Name(), server.KBuckets.SelfNode().Address)
+	}
+
+	// Renewal at half the lifetime picks up a new external address.
+	gateway.setExternal(net.IPv4(203, 0, 113, 2))
+	want := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 2), Port: 55321}
+	for deadline := time.Now().Add(3 * time.Second); !SameAddr(server.mappedAddr(), want); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping is not renewed, external address %s", server.mappedAddr())
+		}
+	}
+	if !SameAddr(server.KBuckets.SelfNode().Address, want) {
+		t.Fatalf("self at %s after renewal", server.KBuckets.SelfNode().Address)
+	}
+
+	if err = server.UnmapPort(); err != nil || gateway.mapped(54321) || server.mappedAddr() != nil {
+		t.Fatalf("port is not unmapped: %v", err)
+	}
+}
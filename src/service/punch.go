@@ -0,0 +1,216 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+Hole punching:
+A wants to reach B, both of them could reach a rendezvous node R.
+1. A sends Connect(B's NodeID) to R.
+2. R sends Introduce(A's observed contact) to B, and replies A with B's observed contact.
+3. A and B ping each other at the same time. The first ping passing both NATs opens the path.
+4. Whoever receives a pong records the peer into its routing table.
+B only accepts introductions from a contact which has responded to its own requests at the same address, e.g.
+keepalives keeping its NAT binding to R. Otherwise anyone could make B ping an arbitrary address PunchAttempts
+times, reflecting traffic to it.
+*/
+
+// Connect statuses
+const (
+	connectOK byte = iota
+	connectNotFound
+)
+
+// Fields of Connect.
+const (
+	connectTarget byte = iota + 1
+	connectStatus
+	connectContact
+)
+
+// DataConnect is connect payload.
+// Request:  | Target NodeID |
+// Response: | Status | Target contact if found |
+type DataConnect struct {
+	Target  *NodeID
+	Status  byte
+	Contact *Node
+}
+
+// NewConnect creates connect request payload.
+func NewConnect(target *NodeID) *DataConnect {
+	return &DataConnect{Target: target}
+}
+
+// NewConnectReply creates connect response payload. target is nil if not found.
+func NewConnectReply(target *Node) *DataConnect {
+	if target == nil || target.Dumps() == nil {
+		return &DataConnect{Status: connectNotFound}
+	}
+	return &DataConnect{Status: connectOK, Contact: target}
+}
+
+// Encode encodes the payload.
+func (connect *DataConnect) Encode(encoder *Encoder) {
+	if connect.Target != nil {
+		encoder.ID(connectTarget, connect.Target)
+		return
+	}
+	encoder.Uint(connectStatus, uint64(connect.Status))
+	if connect.Contact != nil {
+		encoder.Contact(connectContact, connect.Contact)
+	}
+}
+
+// Decode decodes the payload.
+func (connect *DataConnect) Decode(decoder *Decoder, isReq bool) error {
+	hasStatus := false
+	for decoder.Next() {
+		switch decoder.Tag() {
+		case connectTarget:
+			connect.Target = decoder.ID()
+		case connectStatus:
+			connect.Status, hasStatus = byte(decoder.Uint(0xFF)), true
+		case connectContact:
+			connect.Contact = decoder.Contact()
+		}
+	}
+	switch {
+	case decoder.Err() != nil:
+		return decoder.Err()
+	case isReq && connect.Target == nil:
+		return missing("target")
+	case !isReq && !hasStatus:
+		return missing("status")
+	case !isReq && connect.Status == connectOK && connect.Contact == nil:
+		return missing("contact")
+	}
+	return nil
+}
+
+// Fields of Introduce.
+const (
+	introducePeer byte = iota + 1
+)
+
+// DataIntroduce is introduce payload.
+// Request:  | Requester contact |
+// Response: empty
+type DataIntroduce struct {
+	Peer *Node
+}
+
+// NewIntroduce creates introduce payload. peer is nil for a response.
+func NewIntroduce(peer *Node) *DataIntroduce {
+	return &DataIntroduce{peer}
+}
+
+// Encode encodes the payload.
+func (introduce *DataIntroduce) Encode(encoder *Encoder) {
+	if introduce.Peer != nil {
+		encoder.Contact(introducePeer, introduce.Peer)
+	}
+}
+
+// Decode decodes the payload.
+func (introduce *DataIntroduce) Decode(decoder *Decoder, isReq bool) error {
+	for decoder.Next() {
+		if decoder.Tag() == introducePeer {
+			introduce.Peer = decoder.Contact()
+		}
+	}
+	if decoder.Err() == nil && isReq && introduce.Peer == nil {
+		return missing("peer")
+	}
+	return decoder.Err()
+}
+
+// Connect asks a rendezvous node to introduce local node to target, then punches a hole to it.
+// On success the peer is recorded into the routing table and returned.
+func (server *Server) Connect(target *NodeID, rendezvous *Node) (*Node, error) {
+	timeout := seconds(server.config.PunchTimeout)
+	resDatagram := server.request(Connect, NewConnect(target), rendezvous.Address, timeout)
+	if resDatagram == nil {
+		return nil, errors.New("rendezvous node did not respond")
+	}
+	connect, ok := resDatagram.Data.(*DataConnect)
+	if !ok {
+		return nil, errors.New("rendezvous node responded with another message type")
+	}
+	if connect.Status != connectOK {
+		return nil, errors.New("rendezvous node does not know the target")
+	}
+	peer := connect.Contact
+	if *peer.ID != *target {
+		return nil, errors.New("rendezvous node introduced a wrong node")
+	}
+	if !server.punch(peer) {
+		return nil, errors.New("hole punching failed")
+	}
+	return peer, nil
+}
+
+// punch pings a peer several times concurrently. The first pong means the hole is open.
+func (server *Server) punch(peer *Node) bool {
+	timeout := seconds(server.config.PunchTimeout)
+	caps := server.KBuckets.SelfNode().Capabilities
+	succeeded := make(chan bool, server.config.PunchAttempts)
+	var wg sync.WaitGroup
+	for i := 0; i < server.config.PunchAttempts; i++ {
+		wg.Add(1)
+		go func(delay time.Duration) {
+			defer wg.Done()
+			if !server.sleep(delay) {
+				return
+			}
+			if server.pingTimeout(peer, &caps, timeout-delay) {
+				succeeded <- true
+			}
+		}(time.Duration(i*server.config.PunchInterval) * time.Millisecond)
+	}
+	go func() {
+		wg.Wait()
+		close(succeeded)
+	}()
+	if _, ok := <-succeeded; !ok {
+		return false
+	}
+	server.KBuckets.Add(peer.ID, peer.Address)
+	log.Printf("Hole punched to %s\n", peer)
+	return true
+}
+
+// response Connect request. The target is introduced before the reply so that it starts punching in time.
+func (server *Server) reConnect(datagram *Datagram) {
+	connect, ok := datagram.Data.(*DataConnect)
+	if !ok {
+		return
+	}
+	target := server.KBuckets.Get(connect.Target)
+	if target != nil {
+		introduce := NewDatagram(server.Clock, Introduce, true, nil, server.KBuckets.Self, NewIntroduce(datagram.SourceNode))
+		if introduce == nil {
+			return
+		}
+		server.send(introduce, target.Address)
+	}
+	server.reply(datagram, NewConnectReply(target))
+}
+
+// response Introduce request, then punch to the introduced peer.
+func (server *Server) reIntroduce(datagram *Datagram) {
+	introduce, ok := datagram.Data.(*DataIntroduce)
+	if !ok {
+		return
+	}
+	if !server.KBuckets.hasResponded(datagram.SourceNode.ID, datagram.SourceNode.Address) {
+		log.Printf("introduction from unknown rendezvous %s is ignored\n", datagram.SourceNode)
+		return
+	}
+	server.reply(datagram, NewIntroduce(nil))
+	server.punch(introduce.Peer)
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newMemServer starts a server on addr of network, behind nat if not nil. It is stopped once the test ends.
+func newMemServer(t *testing.T, network *MemNetwork, addr *net.UDPAddr, nat *MemNAT) *Server {
+	t.Helper()
+	conn, err := network.Listen(addr, nat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	cfg.RequestTimeout = 2
+	server := NewServerOn(NewBucketTree(cfg), cfg, network.Clock, conn)
+	if server == nil {
+		t.Fatal("failed to create server")
+	}
+	server.StartService()
+	t.Cleanup(func() { server.Stop(context.Background()) })
+	return server
+}
+
+// waitFor polls condition for a second.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestPunchThroughNATs(t *testing.T) {
+	network := NewMemNetwork(1)
+	rendezvous := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	natA, _ := network.NewNAT(NATPortRestricted, net.IPv4(203, 0, 113, 1), 0)
+	natB, _ := network.NewNAT(NATPortRestricted, net.IPv4(203, 0, 113, 2), 0)
+	a := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, natA)
+	b := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 54321}, natB)
+
+	r := rendezvous.KBuckets.SelfNode()
+	for _, server := range []*Server{a, b} {
+		server.KBuckets.Add(r.ID, r.Address)
+		if !server.Ping(r) {
+			t.Fatal("rendezvous node did not respond")
+		}
+	}
+	bID := b.KBuckets.Self.ID
+	waitFor(t, "rendezvous learning B", func() bool { return rendezvous.KBuckets.Get(bID) != nil })
+
+	peer, err := a.Connect(bID, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := peer.Address.(*net.UDPAddr); !addr.IP.Equal(natB.IP) {
+		t.Fatalf("connected to %s, want B's NAT", addr)
+	}
+	aID := a.KBuckets.Self.ID
+	waitFor(t, "B learning A", func() bool {
+		node := b.KBuckets.Get(aID)
+		return node != nil && node.Address.(*net.UDPAddr).IP.Equal(natA.IP)
+	})
+}
+
+func TestIntroduceFromStrangerIsIgnored(t *testing.T) {
+	network := NewMemNetwork(1)
+	b := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	victim, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 80}, nil)
+	defer victim.Close()
+	stranger, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 54321}, nil)
+	defer stranger.Close()
+
+	// The stranger may even be a contact, as long as it has never responded to B.
+	strangerNode := &Node{ID: NewRandNodeID(), Address: stranger.LocalAddr()}
+	b.KBuckets.Add(strangerNode.ID, strangerNode.Address)
+	introduce := NewDatagram(SystemClock, Introduce, true, nil, strangerNode, NewIntroduce(&Node{ID: NewRandNodeID(), Address: victim.LocalAddr()}))
+	stranger.WriteTo(introduce.Dumps(), b.KBuckets.SelfNode().Address)
+
+	victim.SetReadDeadline(time.Now().Add(time.Duration(b.config.PunchAttempts*b.config.PunchInterval)*time.Millisecond + 200*time.Millisecond))
+	var buffer [MaxPackageSize]byte
+	if _, from, err := victim.ReadFrom(buffer[:]); err == nil {
+		t.Fatalf("victim received a packet from %s", from)
+	}
+}
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Relay:
+When hole punching fails, a node behind symmetric NAT reserves a slot on a publicly reachable relay node,
+and advertises the relay's address as a TransportRelay endpoint.
+Everyone talks to a relayed node by sending RelayData(target NodeID, inner datagram) to the relay,
+and the relay forwards it as is. The relay only forwards datagrams to its reserved clients, and from them
+to the peers which have sent to them through the relay.
+*/
+
+// Relay reserve statuses
+const (
+	relayOK byte = iota
+	relayRefused
+)
+
+// RelayAddr is the address of a node reached through a relay.
+type RelayAddr struct {
+	Relay  net.Addr
+	Target NodeID
+}
+
+// Network returns the network name.
+func (addr *RelayAddr) Network() string {
+	return "relay"
+}
+
+func (addr *RelayAddr) String() string {
+	return fmt.Sprintf("%x via %s", addr.Target, addr.Relay.String())
+}
+
+// Fields of RelayReserve.
+const (
+	reserveStatus byte = iota + 1
+	reserveLifetime
+)
+
+// DataRelayReserve is relay reserve payload.
+// Request:  empty
+// Response: | Status | Lifetime in seconds |
+type DataRelayReserve struct {
+	Status   byte
+	Lifetime int
+	isReq    bool
+}
+
+// NewRelayReserve creates relay reserve payload. Lifetime is only used for a response.
+func NewRelayReserve(isReq bool, status byte, lifetime int) *DataRelayReserve {
+	return &DataRelayReserve{status, lifetime, isReq}
+}
+
+// Encode encodes the payload.
+func (reserve *DataRelayReserve) Encode(encoder *Encoder) {
+	if !reserve.isReq {
+		encoder.Uint(reserveStatus, uint64(reserve.Status))
+		encoder.Uint(reserveLifetime, uint64(reserve.Lifetime))
+	}
+}
+
+// Decode decodes the payload.
+func (reserve *DataRelayReserve) Decode(decoder *Decoder, isReq bool) error {
+	reserve.isReq = isReq
+	hasStatus := false
+	for decoder.Next() {
+		switch decoder.Tag() {
+		case reserveStatus:
+			reserve.Status, hasStatus = byte(decoder.Uint(0xFF)), true
+		case reserveLifetime:
+			reserve.Lifetime = int(decoder.Uint(math.MaxUint32))
+		}
+	}
+	if decoder.Err() == nil && !isReq && !hasStatus {
+		return missing("status")
+	}
+	return decoder.Err()
+}
+
+// Fields of RelayData.
+const (
+	relayTarget byte = iota + 1
+	relayInner
+)
+
+// DataRelay is relay data payload.
+// | Target NodeID | Inner datagram |
+type DataRelay struct {
+	Target *NodeID
+	Inner  []byte
+}
+
+// NewRelayData creates relay data payload.
+func NewRelayData(target *NodeID, inner []byte) *DataRelay {
+	return &DataRelay{target, inner}
+}
+
+// Encode encodes the payload.
+func (relay *DataRelay) Encode(encoder *Encoder) {
+	encoder.ID(relayTarget, relay.Target)
+	encoder.Bytes(relayInner, relay.Inner)
+}
+
+// Decode decodes the payload. The inner datagram refers to the payload, and is checked once it arrives at the
+// target. Relayed datagrams are never responded.
+func (relay *DataRelay) Decode(decoder *Decoder, isReq bool) error {
+	for decoder.Next() {
+		switch decoder.Tag() {
+		case relayTarget:
+			relay.Target = decoder.ID()
+		case relayInner:
+			relay.Inner = decoder.Bytes()
+		}
+	}
+	switch {
+	case decoder.Err() != nil:
+		return decoder.Err()
+	case relay.Target == nil:
+		return missing("target")
+	case len(relay.Inner) < HeaderLength:
+		return missing("inner datagram")
+	case !isReq:
+		return datagramError("type", ErrUnknownType)
+	}
+	return nil
+}
+
+// Relay serves relay sessions for NATed nodes.
+type Relay struct {
+	MaxSessions int
+	Bandwidth   int // Bytes per second per session.
+	sessions    map[NodeID]*relaySession
+	clock       Clock
+	lock        *sync.Mutex
+}
+
+// maxRelayPeers limits the peers recorded for a session.
+const maxRelayPeers = 256
+
+// relaySession is a reserved slot. Bandwidth is limited by a token bucket.
+type relaySession struct {
+	address  net.Addr
+	expire   time.Time
+	tokens   float64
+	lastFill time.Time
+	peers    map[NodeID]net.Addr // Addresses of the peers which sent to the client, where its replies go.
+}
+
+// NewRelay creates a relay with limits. Sessions expire by clock.
+func NewRelay(maxSessions, bandwidth int, clock Clock) *Relay {
+	return &Relay{maxSessions, bandwidth, make(map[NodeID]*relaySession), clock, &sync.Mutex{}}
+}
+
+// reserve creates or refreshes a session. Return false if no slot is left.
+func (relay *Relay) reserve(id *NodeID, addr net.Addr, lifetime time.Duration) bool {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	now := relay.clock.Now()
+	session, isExist := relay.sessions[*id]
+	if !isExist {
+		relay.collect(now)
+		if len(relay.sessions) >= relay.MaxSessions {
+			return false
+		}
+		session = &relaySession{tokens: float64(relay.Bandwidth), lastFill: now, peers: make(map[NodeID]net.Addr)}
+		relay.sessions[*id] = session
+	}
+	session.address = addr
+	session.expire = now.Add(lifetime)
+	return true
+}
+
+// collect removes expired sessions. Lock must be held.
+func (relay *Relay) collect(now time.Time) {
+	for id, session := range relay.sessions {
+		if now.After(session.expire) {
+			delete(relay.sessions, id)
+		}
+	}
+}
+
+// available returns the number of free slots.
+func (relay *Relay) available() int {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.collect(relay.clock.Now())
+	return relay.MaxSessions - len(relay.sessions)
+}
+
+// session returns a reserved session, nil if not reserved. Lock must be held.
+func (relay *Relay) session(id *NodeID, now time.Time) *relaySession {
+	session, isExist := relay.sessions[*id]
+	if !isExist || now.After(session.expire) {
+		return nil
+	}
+	return session
+}
+
+// charge takes size bytes from the session's bucket. Return false if over limit. Lock must be held.
+func (relay *Relay) charge(session *relaySession, now time.Time, size int) bool {
+	session.tokens += now.Sub(session.lastFill).Seconds() * float64(relay.Bandwidth)
+	if session.tokens > float64(relay.Bandwidth) {
+		session.tokens = float64(relay.Bandwidth)
+	}
+	session.lastFill = now
+	if session.tokens < float64(size) {
+		return false
+	}
+	session.tokens -= float64(size)
+	return true
+}
+
+// isClient tells whether a node has reserved a slot.
+func (relay *Relay) isClient(id *NodeID) bool {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	return relay.session(id, relay.clock.Now()) != nil
+}
+
+// toClient charges size bytes from peer towards a client on the client, and records the peer's address
+// for the client's replies. Return the client's address, nil if not reserved or over limit.
+func (relay *Relay) toClient(client, peer *NodeID, peerAddr net.Addr, size int) net.Addr {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	now := relay.clock.Now()
+	session := relay.session(client, now)
+	if session == nil || !relay.charge(session, now, size) {
+		return nil
+	}
+	if _, isExist := session.peers[*peer]; isExist || len(session.peers) < maxRelayPeers {
+		session.peers[*peer] = peerAddr
+	}
+	return session.address
+}
+
+// fromClient charges size bytes from a client at addr towards peer on the client. The peer must have sent to
+// the client through the relay, since the client is not necessarily in the relay's routing table.
+// Return the peer's address, nil if the client is not reserved at addr, the peer is unknown or over limit.
+func (relay *Relay) fromClient(client *NodeID, addr net.Addr, peer *NodeID, size int) net.Addr {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	now := relay.clock.Now()
+	session := relay.session(client, now)
+	if session == nil || !SameAddr(session.address, addr) {
+		return nil
+	}
+	peerAddr, isExist := session.peers[*peer]
+	if !isExist || !relay.charge(session, now, size) {
+		return nil
+	}
+	return peerAddr
+}
+
+// EnableRelay makes local node serve as a relay and advertises its free slots.
+func (server *Server) EnableRelay(maxSessions, bandwidth int) {
+	server.relay = NewRelay(maxSessions, bandwidth, server.Clock)
+	server.KBuckets.updateSelf(func(self *Node) { self.Capabilities.RelaySlots = uint16(maxSessions) })
+}
+
+// ReserveRelay reserves a slot on a relay node, advertises the relayed endpoint,
+// and keeps refreshing the reservation until it is refused or the server stops.
+func (server *Server) ReserveRelay(relayNode *Node) error {
+	lifetime, err := server.reserveRelay(relayNode)
+	if err != nil {
+		return err
+	}
+	server.KBuckets.updateSelf(func(self *Node) {
+		self.Endpoints = append(self.Endpoints, Endpoint{TransportRelay, &RelayAddr{relayNode.Address, *self.ID}})
+	})
+	log.Printf("Reserved a relay slot on %s for %d seconds.\n", relayNode, lifetime)
+	server.spawn(func() {
+		for server.sleep(time.Duration(server.config.RelayRefreshInterval) * time.Second) {
+			if _, err := server.reserveRelay(relayNode); err != nil {
+				log.Printf("failed to refresh relay reservation on %s: %s\n", relayNode, err)
+			}
+		}
+	})
+	return nil
+}
+
+// AddNode adds a node learned from a node string. If it does not respond at its address but advertises
+// a relay endpoint, it is added at the relay instead.
+func (server *Server) AddNode(node *Node) error {
+	if relayAddr := node.RelayEndpoint(); relayAddr != nil && !SameAddr(node.Address, relayAddr) && !server.Ping(node) {
+		relayed := *node
+		relayed.Address = relayAddr
+		return server.KBuckets.AddNode(&relayed)
+	}
+	return server.KBuckets.AddNode(node)
+}
+
+// reserveRelay sends a relay reserve request and returns the granted lifetime.
+func (server *Server) reserveRelay(relayNode *Node) (int, error) {
+	resDatagram := server.request(RelayReserve, NewRelayReserve(true, 0, 0), relayNode.Address, seconds(server.config.RequestTimeout))
+	if resDatagram == nil {
+		return 0, errors.New("relay node did not respond")
+	}
+	reserve, ok := resDatagram.Data.(*DataRelayReserve)
+	if !ok {
+		return 0, errors.New("relay node responded with another message type")
+	}
+	if reserve.Status != relayOK {
+		return 0, errors.New("relay node refused the reservation")
+	}
+	return reserve.Lifetime, nil
+}
+
+// response RelayReserve request.
+func (server *Server) reRelayReserve(datagram *Datagram) {
+	if server.relay == nil || !server.relay.reserve(datagram.SourceNode.ID, datagram.SourceNode.Address, time.Duration(server.config.RelaySessionLifetime)*time.Second) {
+		server.reply(datagram, NewRelayReserve(false, relayRefused, 0))
+		return
+	}
+	slots := uint16(server.relay.available())
+	server.KBuckets.updateSelf(func(self *Node) { self.Capabilities.RelaySlots = slots })
+	server.reply(datagram, NewRelayReserve(false, relayOK, server.config.RelaySessionLifetime))
+}
+
+// reRelayData forwards or unwraps relayed datagrams.
+func (server *Server) reRelayData(datagram *Datagram) {
+	relayData, ok := datagram.Data.(*DataRelay)
+	if !ok {
+		return
+	}
+	target, inner := *relayData.Target, relayData.Inner
+
+	// Arrived at the destination.
+	if target == *server.KBuckets.Self.ID {
+		innerDatagram := AcquireDatagram()
+		err := checkCompressed(inner, server.config.Compression)
+		if err == nil {
+			err = innerDatagram.Loads(inner, nil)
+		}
+		if err != nil {
+			server.Malformed.add(datagram.SourceNode.Address, err)
+			innerDatagram.Release()
+			return
+		}
+		// Replies go back through the relay.
+		innerDatagram.SourceNode.Address = &RelayAddr{datagram.SourceNode.Address, *innerDatagram.SourceNode.ID}
+		server.dispatch(innerDatagram)
+		return
+	}
+
+	// Forward as a relay.
+	if server.relay == nil {
+		return
+	}
+	source := datagram.SourceNode.ID
+	if server.relay.isClient(&target) {
+		// Towards a client, charged on the client.
+		if addr := server.relay.toClient(&target, source, datagram.SourceNode.Address, len(inner)); addr != nil {
+			server.forwardRelayData(&target, inner, addr)
+		}
+	} else if addr := server.relay.fromClient(source, datagram.SourceNode.Address, &target, len(inner)); addr != nil {
+		// From a client, charged on the client.
+		server.forwardRelayData(&target, inner, addr)
+	}
+}
+
+// forwardRelayData sends a relay data datagram to addr.
+func (server *Server) forwardRelayData(target *NodeID, inner []byte, addr net.Addr) {
+	relayDatagram := NewDatagram(server.Clock, RelayData, true, nil, server.KBuckets.Self, NewRelayData(target, inner))
+	if relayDatagram == nil {
+		return
+	}
+	server.send(relayDatagram, addr)
+}
+
+// writeTo writes bytes to an address. Datagrams to a RelayAddr are encapsulated and sent to the relay.
+// Errors of a write queued for batching are reported to failed if not nil, since writeTo has returned by then.
+func (server *Server) writeTo(bytes []byte, addr net.Addr, failed func(error)) error {
+	if relayAddr, ok := addr.(*RelayAddr); ok {
+		relayDatagram := NewDatagram(server.Clock, RelayData, true, nil, server.KBuckets.Self, NewRelayData(&relayAddr.Target, bytes))
+		if relayDatagram == nil {
+			return errors.New("datagram too large to relay")
+		}
+		addr = relayAddr.Relay
+		buffer := GetBuffer()
+		defer PutBuffer(buffer)
+		bytes = relayDatagram.DumpsTo(buffer)
+	}
+	if len(bytes) > MaxPackageSize {
+		return errors.New("datagram too large")
+	}
+	if server.Keepalive != nil {
+		server.Keepalive.sent()
+	}
+	if server.writer != nil && server.writer.write(bytes, addr, failed) {
+		return nil
+	}
+	_, err := server.conn.WriteTo(bytes, addr)
+	return err
+}
@@ -1,17 +1,54 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 // Server struct used for communication
 type Server struct {
+	config      *Config
 	CookieTable Table
+	signer      *CookieSigner
 	KBuckets    *BucketTree
-	conn        net.PacketConn
-	stop        bool
+	conn        net.PacketConn   // The socket used for writing.
+	conns       []net.PacketConn // Sockets sharing the port, each of which has a reader.
+	writer      *batchWriter     // Nil if batched writing is unavailable.
+	stun        *STUNClient
+	Signaller   *Signaller // Nil if XMPP signalling is not configured.
+	relay       *Relay     // Nil if local node does not serve as a relay.
+	observed    *Observations
+	portMapping *PortMapping
+	Keepalive   *Keepalive
+	Malformed   *Malformed
+	Events      *EventBus // See events.go.
+	// ListenProbe opens a socket for probing NAT binding lifetime apart from other traffic, see keepalive.go.
+	// NewServer opens one on a random port, and probing is off if nil.
+	ListenProbe func() (net.PacketConn, error)
+	// Clock measures timeouts, expiry and intervals of the server, see NewServerOn.
+	Clock Clock
+	// SnapshotPath is where the bucket tree is saved on Stop, nothing is saved if empty.
+	SnapshotPath string
+
+	stop    chan struct{}  // Closed once the server is stopping.
+	lock    sync.Mutex     // Guards spawning against stop.
+	readers sync.WaitGroup // Read loops.
+	loops   sync.WaitGroup // Background loops and in-flight requests of local node, see spawn.
+
+	// Worker pools per traffic class, see workers.go.
+	responses *WorkerPool
+	requests  *WorkerPool
+	punches   *WorkerPool
+	relays    *WorkerPool
+	probes    *WorkerPool
+	welcomes  *WorkerPool
+
+	delayedProbes *delayedProbes // See reProbe.
 }
 
 // Protocol is an interface defines all possible types of communication.
@@ -19,100 +56,460 @@ type Protocol interface {
 	Ping(*Node) bool
 }
 
-// NewServer creates a server
-// It must load from an existing K-Bucket tree instance.
-func NewServer(tree *BucketTree) *Server {
-	if tree == nil {
+// NewServer creates a server listening on the configured port.
+// It must load from an existing K-Bucket tree instance. The tree shares the server's config.
+func NewServer(tree *BucketTree, cfg *Config) *Server {
+	if tree == nil || cfg == nil {
 		return nil
 	}
-	// Listening local port.
-	conn, err := net.ListenPacket("udp", fmt.Sprintf(`:%d`, Port))
+	conns, err := listen(cfg)
 	if err != nil {
 		return nil
 	}
-	return tree.SetServerInstance(&Server{NewCookieTable(), tree, conn, false})
+	server := NewServerOn(tree, cfg, SystemClock, conns...)
+	if server == nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil
+	}
+	server.ListenProbe = func() (net.PacketConn, error) {
+		return net.ListenPacket("udp", ":0")
+	}
+	return server
+}
+
+// NewServerOn creates a server on given transports, e.g. UDP sockets or MemConns, each of which gets a reader.
+// Packets are written through the first one. The server owns the transports and closes them on Stop.
+// Time is told by clock, e.g. SystemClock, or a FakeClock which is advanced by hand.
+func NewServerOn(tree *BucketTree, cfg *Config, clock Clock, conns ...net.PacketConn) *Server {
+	if tree == nil || cfg == nil || clock == nil || len(conns) == 0 {
+		return nil
+	}
+	tree.config = cfg
+	signer := NewCookieSigner(seconds(cfg.RequestTimeout), clock)
+	if signer == nil {
+		return nil
+	}
+	conn := conns[0]
+	// A transport bound to a specific address is reachable by it, until STUN tells otherwise.
+	if localAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !localAddr.IP.IsUnspecified() {
+		tree.Self.Address = localAddr
+	}
+	return tree.SetServerInstance(&Server{config: cfg, Clock: clock, CookieTable: NewCookieTable(clock), signer: signer, KBuckets: tree, conn: conn, conns: conns,
+		writer: newBatchWriter(conn, cfg.BatchSize), stun: NewSTUNClient(conn, clock), observed: NewObservations(), Malformed: NewMalformed(), Events: NewEventBus(), delayedProbes: newDelayedProbes(), stop: make(chan struct{})})
+}
+
+// Config returns the effective config of the server.
+func (server *Server) Config() *Config {
+	return server.config
+}
+
+// listen opens the sockets of the server. Several readers share the port by SO_REUSEPORT if configured,
+// otherwise or if unsupported there is a single socket.
+func listen(cfg *Config) ([]net.PacketConn, error) {
+	if cfg.Readers > 1 {
+		conns, err := listenReusePort(cfg.Port, cfg.Readers)
+		if err == nil {
+			return conns, nil
+		}
+		log.Printf("failed to listen with %d readers, fall back to one: %s\n", cfg.Readers, err)
+	}
+	conn, err := listenDualStack(cfg.Port)
+	if err != nil {
+		return nil, err
+	}
+	return []net.PacketConn{conn}, nil
+}
+
+// listenDualStack listens local port on both IPv6 and IPv4.
+// IPv4 peers show up as IPv4-mapped IPv6 addresses. If IPv6 is unavailable, fall back to IPv4 only.
+func listenDualStack(port int) (net.PacketConn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified, Port: port})
+	if err == nil {
+		return conn, nil
+	}
+	log.Printf("dual-stack listening failed, fall back to IPv4: %s\n", err)
+	return net.ListenPacket("udp4", fmt.Sprintf(`:%d`, port))
 }
 
 // StartService starts the message handler loop.
 // This function deals with recognizing incoming data type and distributing to other handlers.
 func (server *Server) StartService() {
-	// Start response & request handler
-	responseChan := make(chan *Datagram, ResponseHandlerQueueLength)
-	requestChan := make(chan *Datagram, RequestHandlerQueueLength)
-	go server.responseHandler(responseChan)
-	go server.requestHandler(requestChan)
+	// Keepalive records outgoing traffic from now on.
+	server.Keepalive = newKeepalive(server)
 
-	// Incoming messages detection and distribution loop
-	go func() {
-		var buffer [MaxPackageSize]byte
-		var datagram *Datagram
-		defer server.conn.Close()
-		for {
-			if server.stop {
-				break // STOP
+	// Start response & request handlers
+	cfg := server.config
+	server.responses = newWorkerPool("responses", cfg.ResponseWorkers, cfg.ResponseHandlerQueueLength, server.responseHandler)
+	server.requests = newWorkerPool("requests", cfg.RequestWorkers, cfg.RequestHandlerQueueLength, server.requestHandler)
+	server.punches = newWorkerPool("punches", cfg.RequestWorkers, cfg.RequestHandlerQueueLength, server.requestHandler)
+	server.relays = newWorkerPool("relays", cfg.RelayWorkers, cfg.RequestHandlerQueueLength, server.requestHandler)
+	server.probes = newWorkerPool("probes", probeWorkers, cfg.RequestHandlerQueueLength, server.requestHandler)
+	server.welcomes = newWorkerPool("welcomes", cfg.RequestWorkers, cfg.RequestHandlerQueueLength, server.welcomeNode)
+
+	// Incoming messages detection and distribution loops
+	server.readers.Add(len(server.conns))
+	for _, conn := range server.conns {
+		go func(conn net.PacketConn) {
+			defer server.readers.Done()
+			server.readLoop(conn)
+		}(conn)
+	}
+	// Detection waits for STUN servers up to STUNTimeout each, thus it runs in background. The port is mapped
+	// once the NAT type is known.
+	server.spawn(func() {
+		server.detectNetwork()
+		if server.config.PortMapping && server.KBuckets.SelfNode().Capabilities.NAT != NATOpen {
+			if _, err := server.MapPort(DefaultPortMappers(seconds(server.config.PortMappingTimeout))); err != nil {
+				log.Printf("failed to map port on the gateway: %s\n", err)
 			}
-			n, addr, err := server.conn.ReadFrom(buffer[:])
-			// Any IO error or length less than minimal possible length will be abandoned.
-			if err != nil || n < (CookieLength+NodeIDLength+9) {
-				continue
+		}
+		server.watchNetwork()
+	})
+	server.spawn(server.Keepalive.run)
+	if server.config.StatelessCookies {
+		server.spawn(func() {
+			for server.sleep(seconds(server.config.RequestTimeout)) {
+				server.KBuckets.sweepEvictions()
 			}
-			datagram = new(Datagram).Loads(buffer[:n], addr)
+		})
+	}
+}
 
-			// Welcome every node except the msg is a pong response
-			// Place welcome here because I simply don't want to pass argument `addr` to upper layer.
-			if datagram.Type != Ping || datagram.IsRequest {
-				go server.welcomeNode(datagram)
+// readLoopSingle reads packets one by one from a socket until the server stops.
+func (server *Server) readLoopSingle(conn net.PacketConn) {
+	for {
+		buffer := GetBuffer()
+		n, addr, err := conn.ReadFrom(buffer)
+		// Any IO error will be abandoned.
+		if err != nil {
+			PutBuffer(buffer)
+			if server.stopping() {
+				return // STOP
 			}
+			continue
+		}
+		server.handlePacket(conn, buffer, n, addr)
+	}
+}
 
-			if datagram.IsRequest {
-				requestChan <- datagram
-				continue
-			} else {
-				// If incoming message is a response to a former request from self
-				responseChan <- datagram
-				continue
-			}
+// handlePacket recognizes a packet of n bytes read into buffer, and takes over the buffer.
+func (server *Server) handlePacket(conn net.PacketConn, buffer []byte, n int, addr net.Addr) {
+	// STUN messages share the port, so that the detected address is exactly the one peers see.
+	if IsSTUNMessage(buffer[:n]) {
+		if !server.stun.Handle(buffer[:n]) {
+			HandleSTUNRequest(conn, buffer[:n], addr)
 		}
+		PutBuffer(buffer)
+		return
+	}
+	// The datagram takes over the buffer, see pool.go.
+	datagram := AcquireDatagram()
+	datagram.buffer = buffer
+	// Malformed packets are counted and abandoned.
+	err := checkCompressed(buffer[:n], server.config.Compression)
+	if err == nil {
+		err = datagram.LoadsView(buffer[:n], addr)
+	}
+	if err != nil {
+		server.Malformed.add(addr, err)
+		datagram.Release()
+		return
+	}
+	server.dispatch(datagram)
+}
+
+// dispatch welcomes the source node and distributes a datagram to the worker pool of its traffic class.
+func (server *Server) dispatch(datagram *Datagram) {
+	// Welcome every node except the msg is a pong response
+	// Place welcome here because I simply don't want to pass argument `addr` to upper layer.
+	// The welcome pool gets a copy since the datagram is released once handled.
+	// Probes come from a separate socket of the requester, see Keepalive.request, which is not welcomed.
+	if (datagram.Type != Ping || datagram.IsRequest) && datagram.Type != Probe {
+		server.welcomes.submit(datagram.Clone())
+	}
+
+	if !datagram.IsRequest {
+		// If incoming message is a response to a former request from self
+		server.responses.submit(datagram)
+		return
+	}
+	switch datagram.Type {
+	case Connect, Introduce:
+		// Hole punching holds a worker for a while.
+		server.punches.submit(datagram)
+	case RelayData:
+		server.relays.submit(datagram)
+	case Probe:
+		server.probes.submit(datagram)
+	default:
+		server.requests.submit(datagram)
+	}
+}
+
+// PoolStats returns counters of all worker pools.
+func (server *Server) PoolStats() []PoolStats {
+	stats := []PoolStats{}
+	for _, pool := range []*WorkerPool{server.responses, server.requests, server.punches, server.relays, server.probes, server.welcomes} {
+		if pool != nil {
+			stats = append(stats, pool.Stats())
+		}
+	}
+	return stats
+}
+
+// detectNetwork detects public address and NAT type of local node.
+func (server *Server) detectNetwork() {
+	if _, err := server.DetectPublicAddr(server.config.STUNServers); err != nil {
+		log.Printf("failed to detect public address: %s\n", err)
+	}
+	natType, err := server.DetectNAT(server.config.STUNServers)
+	if err != nil {
+		log.Printf("failed to detect NAT type: %s\n", err)
+	}
+	log.Println("NAT type: ", natType)
+	// A mapped port is reachable regardless of what STUN sees.
+	server.KBuckets.updateSelf(func(self *Node) {
+		if server.portMapping != nil {
+			self.Address = server.portMapping.External
+		}
+	})
+}
+
+// watchNetwork detects network again whenever local interface addresses change.
+func (server *Server) watchNetwork() {
+	last := interfaceAddrsString()
+	for server.sleep(time.Duration(server.config.NetworkCheckInterval) * time.Second) {
+		current := interfaceAddrsString()
+		if current == last {
+			continue
+		}
+		last = current
+		log.Println("Network change detected.")
+		server.detectNetwork()
+	}
+}
+
+// interfaceAddrsString returns all local interface addresses as a string for comparison.
+func interfaceAddrsString() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(addrs)
+}
+
+// DetectNAT classifies local NAT with the first STUN server supporting RFC 5780, or by mapping alone if none
+// does, and advertises the result in Self.Capabilities.
+func (server *Server) DetectNAT(stunServers []string) (NATType, error) {
+	localPort := 0
+	if localAddr, ok := server.conn.LocalAddr().(*net.UDPAddr); ok {
+		localPort = localAddr.Port
+	}
+	timeout := seconds(server.config.STUNTimeout)
+	natType, lastErr := NATUnknown, errors.New("no stun server configured")
+	var plainServers []net.Addr // Servers answering without RFC 5780.
+	for _, stunServer := range stunServers {
+		stunAddr, err := net.ResolveUDPAddr("udp", stunServer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		natType, lastErr = server.stun.DiscoverNAT(stunAddr, localPort, timeout)
+		if lastErr == nil {
+			break
+		}
+		if errors.Is(lastErr, ErrNoRFC5780) {
+			plainServers = append(plainServers, stunAddr)
+		}
+	}
+	if lastErr != nil && len(plainServers) > 0 {
+		natType, lastErr = server.stun.ClassifyMapping(plainServers, localPort, timeout)
+	}
+	server.KBuckets.updateSelf(func(self *Node) {
+		self.Capabilities.NAT = natType
+	})
+	return natType, lastErr
+}
+
+// DetectPublicAddr finds local node's public address by STUN servers from the listening socket,
+// and updates Self.Address. Servers are tried in order until one of them answers.
+func (server *Server) DetectPublicAddr(stunServers []string) (net.Addr, error) {
+	if len(stunServers) == 0 {
+		return nil, errors.New("no stun server configured")
+	}
+	var lastErr error
+	for _, stunServer := range stunServers {
+		stunAddr, err := net.ResolveUDPAddr("udp", stunServer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addr, err := server.stun.Binding(stunAddr, seconds(server.config.STUNTimeout))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		log.Println("Local public Address: ", addr)
+		server.KBuckets.updateSelf(func(self *Node) {
+			self.Address = addr
+		})
+		return addr, nil
+	}
+	return nil, lastErr
+}
+
+// spawn runs f in a goroutine which Stop waits for. Nothing is run once the server is stopping.
+func (server *Server) spawn(f func()) bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.stopping() {
+		return false
+	}
+	server.loops.Add(1)
+	go func() {
+		defer server.loops.Done()
+		f()
 	}()
-	WelcomePrint()
+	return true
+}
+
+// stopping tells whether Stop has been called.
+func (server *Server) stopping() bool {
+	select {
+	case <-server.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for d by the server clock, and returns false at once if the server is stopping.
+func (server *Server) sleep(d time.Duration) bool {
+	elapsed, timer := after(server.Clock, d)
+	defer timer.Stop()
+	select {
+	case <-server.stop:
+		return false
+	case <-elapsed:
+		return true
+	}
 }
 
-// Stop stops the server.
-func (server *Server) Stop() {
-	server.stop = true
+// Stop stops the server gracefully. Readers stop first, pending requests of local node are given up, queued
+// datagrams are handled, background loops exit, then sockets are closed and the bucket tree is saved to
+// SnapshotPath. It returns once everything has exited, or with the error of ctx if that takes too long.
+func (server *Server) Stop(ctx context.Context) error {
+	server.lock.Lock()
+	if server.stopping() {
+		server.lock.Unlock()
+		return errors.New("server already stopped")
+	}
+	close(server.stop)
+	server.lock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		// Wake readers up without closing sockets, so that queued requests could still be replied.
+		for _, conn := range server.conns {
+			conn.SetReadDeadline(time.Now())
+		}
+		server.readers.Wait()
+		server.CookieTable.Close()
+		// Relayed datagrams are dispatched to other pools, thus relays stop first.
+		// Pools are nil if the service never started.
+		for _, pool := range []*WorkerPool{server.relays, server.welcomes, server.responses, server.requests, server.punches, server.probes} {
+			if pool != nil {
+				pool.stop()
+			}
+		}
+		server.loops.Wait()
+		if err := server.UnmapPort(); err != nil {
+			log.Printf("failed to remove port mapping: %s\n", err)
+		}
+		if server.Signaller != nil {
+			server.Signaller.Close()
+		}
+		server.writer.close()
+		for _, conn := range server.conns {
+			conn.Close()
+		}
+		if server.SnapshotPath != "" {
+			done <- server.KBuckets.Save(server.SnapshotPath)
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Response handler
 // Route responses causing by former requests from local.
-func (server *Server) responseHandler(inChan <-chan *Datagram) {
-	var datagram *Datagram
-	for {
-		datagram = <-inChan
-		source := server.CookieTable.Get(datagram.MagicCookie)
-		if source == nil {
-			continue
+func (server *Server) responseHandler(datagram *Datagram) {
+	source := server.CookieTable.Remove(datagram.MagicCookie)
+	if source == nil {
+		if server.signer.Verify(datagram.MagicCookie, datagram.Type, datagram.SourceNode.Address) {
+			server.reNotified(datagram)
 		}
-		source <- datagram
+		datagram.Release()
+		return
 	}
+	server.KBuckets.markResponded(datagram.SourceNode.ID, datagram.SourceNode.Address)
+	// Owned by the requester from now on.
+	source <- datagram
 }
 
 // Request handler
-// Reply to incoming requests.
-func (server *Server) requestHandler(outChan <-chan *Datagram) {
-	for {
-		datagram := <-outChan
-		switch datagram.Type {
-		case Ping:
-			go server.rePing(datagram)
-			break
-		}
+// Reply to incoming requests, then release the datagram. Handlers must not retain the datagram.
+func (server *Server) requestHandler(datagram *Datagram) {
+	if server.Events.subscribed() {
+		id := *datagram.SourceNode.ID // The datagram is reused once released.
+		server.Events.Publish(RequestArrived{datagram.Type, Node{ID: &id, Address: datagram.SourceNode.Address}})
+	}
+	switch datagram.Type {
+	case Ping:
+		server.rePing(datagram)
+		break
+	case Connect:
+		server.reConnect(datagram)
+		break
+	case Introduce:
+		server.reIntroduce(datagram)
+		break
+	case RelayReserve:
+		server.reRelayReserve(datagram)
+		break
+	case RelayData:
+		server.reRelayData(datagram)
+		break
+	case Probe:
+		server.reProbe(datagram)
+		break
+	case FindNode:
+		server.reFindNode(datagram)
+		break
 	}
+	datagram.Release()
 }
 
 // Welcome a new node or update a existing node.
-// Simple helper method.
+// Simple helper method. The source node is copied before being added since the datagram is released.
 func (server *Server) welcomeNode(datagram *Datagram) {
-	server.KBuckets.Add(datagram.SourceNode.ID, datagram.SourceNode.Address)
+	defer datagram.Release()
+	id := new(NodeID)
+	*id = *datagram.SourceNode.ID
+	server.KBuckets.Add(id, datagram.SourceNode.Address)
+	// Record capabilities advertised by a ping requester.
+	var ping DataPing
+	if datagram.Type == Ping && datagram.IsRequest && datagram.Decode(&ping) == nil && ping.Caps != nil {
+		server.KBuckets.setCapabilities(id, ping.Caps)
+	}
 }
 
 /*
@@ -122,37 +519,105 @@ Cookies are used for distinguishing incoming data, whether they are meant to req
 
 */
 
-// Ping implementation.
-// This method cannot attach Ping to a RPC reply.
-func (server *Server) Ping(node *Node) bool {
+// request sends a request to an address and waits for its response until timeout.
+// Return nil if failed or timed out.
+func (server *Server) request(msgType byte, payload Payload, addr net.Addr, timeout time.Duration) *Datagram {
 	cookie := NewRandCookie()
 	if cookie == nil {
-		return false
+		return nil
 	}
-	ptrDatagram := NewDatagram(Ping, true, cookie, server.KBuckets.Self, NewPing())
+	ptrDatagram := NewDatagram(server.Clock, msgType, true, cookie, server.KBuckets.Self, payload)
 	if ptrDatagram == nil {
-		return false
+		return nil
 	}
 	resChan := make(chan *Datagram, 1)
-	if server.CookieTable.Add(cookie, resChan) == nil {
-		return false
+	if server.CookieTable.Add(cookie, resChan, timeout) == nil {
+		return nil
 	}
 
-	_, err := server.conn.WriteTo(ptrDatagram.Dumps(), node.Address)
+	// A batched write only fails after send returns, then the cookie expires at once as if timed out.
+	err := server.sendReporting(ptrDatagram, addr, func(error) {
+		if channel := server.CookieTable.Remove(cookie); channel != nil {
+			close(channel)
+		}
+	})
 	if err != nil {
-		return false
+		server.CookieTable.Remove(cookie)
+		return nil
 	}
-	// Wait for response
-	_, ok := <-resChan
-	if ok {
-		return true
+	// Wait for response. The channel is closed once the cookie expires.
+	resDatagram, ok := <-resChan
+	if !ok {
+		return nil
+	}
+	server.observe(resDatagram)
+	return resDatagram
+}
+
+// notify sends a request with a stateless cookie and returns without waiting.
+// Its response is verified by the cookie and handled by reNotified.
+func (server *Server) notify(msgType byte, payload Payload, addr net.Addr) error {
+	datagram := NewDatagram(server.Clock, msgType, true, server.signer.Sign(msgType, addr), server.KBuckets.Self, payload)
+	if datagram == nil {
+		return errors.New("failed to create request")
+	}
+	return server.send(datagram, addr)
+}
+
+// reNotified handles a response to a request sent by notify.
+func (server *Server) reNotified(datagram *Datagram) {
+	server.observe(datagram)
+	switch datagram.Type {
+	case Ping:
+		// The contact is alive, thus it survives eviction, see Bucket.evict.
+		server.KBuckets.Update(datagram.SourceNode.ID)
+		server.KBuckets.markResponded(datagram.SourceNode.ID, datagram.SourceNode.Address)
+	}
+}
+
+// reply sends a response to a request with the request's cookie.
+// The requester's observed address is prepended to every response payload, see DataObserved.
+func (server *Server) reply(datagram *Datagram, payload Payload) error {
+	payload = NewObserved(datagram.SourceNode.Address, payload)
+	resDatagram := NewDatagram(server.Clock, datagram.Type, false, datagram.MagicCookie, server.KBuckets.Self, payload)
+	if resDatagram == nil {
+		return errors.New("failed to create response")
+	}
+	if server.config.Compression && datagram.AcceptsCompressed {
+		resDatagram.Compress()
 	}
-	return false
+	return server.send(resDatagram, datagram.SourceNode.Address)
+}
+
+// send dumps a datagram into a pooled buffer and writes it to an address.
+// Compressed responses are accepted if compression is enabled.
+func (server *Server) send(datagram *Datagram, addr net.Addr) error {
+	return server.sendReporting(datagram, addr, nil)
+}
+
+// sendReporting sends a datagram like send. If the write is queued for batching and fails later, failed is called.
+func (server *Server) sendReporting(datagram *Datagram, addr net.Addr, failed func(error)) error {
+	datagram.AcceptsCompressed = server.config.Compression
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+	return server.writeTo(datagram.DumpsTo(buffer), addr, failed)
+}
+
+// Ping implementation.
+// This method cannot attach Ping to a RPC reply.
+func (server *Server) Ping(node *Node) bool {
+	caps := server.KBuckets.SelfNode().Capabilities
+	return server.pingTimeout(node, &caps, seconds(server.config.RequestTimeout))
+}
+
+// pingTimeout pings a node with local capabilities caps and waits for at most timeout.
+// Callers read caps before taking any lock, since the response takes the tree lock.
+func (server *Server) pingTimeout(node *Node, caps *Capabilities, timeout time.Duration) bool {
+	return server.request(Ping, NewPing(caps), node.Address, timeout) != nil
 }
 
 // response Ping request.
 func (server *Server) rePing(datagram *Datagram) {
-	resDatagram := NewDatagram(Ping, false, datagram.MagicCookie, server.KBuckets.Self, NewPing())
-	server.conn.WriteTo(resDatagram.Dumps(), datagram.SourceNode.Address)
+	server.reply(datagram, NewPing(nil))
 	log.Println("A ping response has been sent out.")
 }
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func BenchmarkHandlePacket(b *testing.B) {
+	network := NewMemNetwork(1)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+	cfg := DefaultConfig()
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	server := NewServerOn(NewBucketTree(cfg), cfg, SystemClock, conn)
+	server.StartService()
+	defer server.Stop(context.Background())
+	source := &Node{ID: NewRandNodeID(), Address: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}}
+	packet := NewDatagram(SystemClock, Ping, true, nil, source, NewPing(nil)).Dumps()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := GetBuffer()
+		server.handlePacket(conn, buffer, copy(buffer, packet), source.Address)
+	}
+}
@@ -0,0 +1,331 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Offer is a signalling message exchanged through XMPP, so that peers behind NATs learn each other's candidates.
+type Offer struct {
+	IsAnswer   bool
+	NodeID     *NodeID
+	Timestamp  uint64 // UnixNano, used against replay.
+	Candidates []*net.UDPAddr
+	PublicKey  ed25519.PublicKey
+}
+
+// DumpSigned dumps an offer and signs it.
+// | IsAnswer | NodeID | Timestamp | Count |       Candidates        | PublicKey | Signature |
+// |    1     |   20   |     8     |   1   | (length 1 + address)... |    32     |    64     |
+func (offer *Offer) DumpSigned(key ed25519.PrivateKey) []byte {
+	buffer := make([]byte, 1+NodeIDLength+8+1, 256)
+	if offer.IsAnswer {
+		buffer[0] = 1
+	}
+	copy(buffer[1:], (*offer.NodeID)[:])
+	binary.LittleEndian.PutUint64(buffer[1+NodeIDLength:], offer.Timestamp)
+	count := 0
+	for _, candidate := range offer.Candidates {
+		addr := DumpUDPAddr(candidate)
+		if addr == nil || count == 255 {
+			continue
+		}
+		buffer = append(buffer, byte(len(addr)))
+		buffer = append(buffer, addr...)
+		count++
+	}
+	buffer[1+NodeIDLength+8] = byte(count)
+	buffer = append(buffer, key.Public().(ed25519.PublicKey)...)
+	return append(buffer, ed25519.Sign(key, buffer)...)
+}
+
+// LoadsVerified loads an offer and verifies its signature with the public key it carries.
+func (offer *Offer) LoadsVerified(bytes []byte) error {
+	p := 1 + NodeIDLength + 8 + 1
+	if len(bytes) < p+ed25519.PublicKeySize+ed25519.SignatureSize {
+		return errors.New("offer too short")
+	}
+	signed := bytes[:len(bytes)-ed25519.SignatureSize]
+	publicKey := ed25519.PublicKey(signed[len(signed)-ed25519.PublicKeySize:])
+	if !ed25519.Verify(publicKey, signed, bytes[len(signed):]) {
+		return errors.New("illegal offer signature")
+	}
+	offer.IsAnswer = bytes[0] == 1
+	offer.NodeID = new(NodeID)
+	copy((*offer.NodeID)[:], bytes[1:])
+	offer.Timestamp = binary.LittleEndian.Uint64(bytes[1+NodeIDLength:])
+	offer.Candidates = nil
+	count := int(bytes[p-1])
+	end := len(signed) - ed25519.PublicKeySize
+	for i := 0; i < count; i++ {
+		if p >= end || p+1+int(bytes[p]) > end {
+			return errors.New("truncated offer candidates")
+		}
+		if addr := LoadUDPAddr(bytes[p+1 : p+1+int(bytes[p])]); addr != nil {
+			offer.Candidates = append(offer.Candidates, addr)
+		}
+		p += 1 + int(bytes[p])
+	}
+	offer.PublicKey = append(ed25519.PublicKey{}, publicKey...)
+	return nil
+}
+
+// KeyPins binds NodeIDs to the public keys which first signed their offers, trust on first use.
+// Pins are appended to a file as | NodeID 20 | ed25519 public key 32 |, so that they survive restarts.
+type KeyPins struct {
+	path string // Empty if pins are only kept in memory.
+	keys map[NodeID]ed25519.PublicKey
+	lock *sync.Mutex
+}
+
+// NewKeyPins creates pins kept in memory.
+func NewKeyPins() *KeyPins {
+	return &KeyPins{keys: make(map[NodeID]ed25519.PublicKey), lock: &sync.Mutex{}}
+}
+
+// LoadKeyPins loads pins from a file, which is created on the first pin.
+func LoadKeyPins(path string) (*KeyPins, error) {
+	pins := NewKeyPins()
+	pins.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	const recordSize = NodeIDLength + ed25519.PublicKeySize
+	if len(data)%recordSize != 0 {
+		return nil, errors.New("illegal key pins file " + path)
+	}
+	for p := 0; p < len(data); p += recordSize {
+		var id NodeID
+		copy(id[:], data[p:])
+		pins.keys[id] = append(ed25519.PublicKey{}, data[p+NodeIDLength:p+recordSize]...)
+	}
+	return pins, nil
+}
+
+// Check reports whether key is the one pinned for id. An unknown id is pinned to key.
+func (pins *KeyPins) Check(id *NodeID, key ed25519.PublicKey) (bool, error) {
+	pins.lock.Lock()
+	defer pins.lock.Unlock()
+	if pinned, isExist := pins.keys[*id]; isExist {
+		return pinned.Equal(key), nil
+	}
+	if pins.path != "" {
+		file, err := os.OpenFile(pins.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return false, err
+		}
+		_, err = file.Write(append(append([]byte{}, id[:]...), key...))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	pins.keys[*id] = append(ed25519.PublicKey{}, key...)
+	return true, nil
+}
+
+// Pinned returns the key pinned for id, nil if not pinned.
+func (pins *KeyPins) Pinned(id *NodeID) ed25519.PublicKey {
+	pins.lock.Lock()
+	defer pins.lock.Unlock()
+	return pins.keys[*id]
+}
+
+// maxOffers limits offers answered and punched at once.
+const maxOffers = 4
+
+// Signaller exchanges offers with peers through XMPP and hands the candidates to hole punching.
+type Signaller struct {
+	server  *Server
+	client  *XMPPClient
+	key     ed25519.PrivateKey
+	pins    *KeyPins // Offers of a NodeID must be signed by the key pinned for it.
+	answers map[JIDAddr]chan *Offer
+	offers  chan struct{} // Slots of offers being handled.
+	lock    *sync.Mutex
+}
+
+// NewSignaller logs into the XMPP account and starts handling incoming offers.
+// If key is nil, a new one is generated. If pins is nil, pins are only kept in memory.
+func NewSignaller(server *Server, account *XMPPAccount, key ed25519.PrivateKey, pins *KeyPins) (*Signaller, error) {
+	if key == nil {
+		var err error
+		if _, key, err = ed25519.GenerateKey(nil); err != nil {
+			return nil, err
+		}
+	}
+	if pins == nil {
+		pins = NewKeyPins()
+	}
+	client, err := DialXMPP(account, seconds(server.config.SignalTimeout))
+	if err != nil {
+		return nil, err
+	}
+	signaller := &Signaller{server, client, key, pins, make(map[JIDAddr]chan *Offer), make(chan struct{}, maxOffers), &sync.Mutex{}}
+	// Advertise the JID so that peers could find local node by its node string.
+	server.KBuckets.updateSelf(func(self *Node) {
+		self.Endpoints = append(self.Endpoints, Endpoint{TransportXMPP, client.JID.Bare()})
+	})
+	server.Signaller = signaller
+	go signaller.serve()
+	log.Println("XMPP signalling online as ", client.JID)
+	return signaller, nil
+}
+
+// Connect sends an offer to a peer's JID, waits for the answer, then punches a hole to its candidates.
+func (signaller *Signaller) Connect(peer JIDAddr) (*Node, error) {
+	answerChan := make(chan *Offer, 1)
+	signaller.lock.Lock()
+	signaller.answers[peer.Bare()] = answerChan
+	signaller.lock.Unlock()
+	defer func() {
+		signaller.lock.Lock()
+		delete(signaller.answers, peer.Bare())
+		signaller.lock.Unlock()
+	}()
+
+	if err := signaller.client.SendOffer(peer, signaller.newOffer(false).DumpSigned(signaller.key)); err != nil {
+		return nil, err
+	}
+	timeout, timer := after(signaller.server.Clock, seconds(signaller.server.config.SignalTimeout))
+	defer timer.Stop()
+	select {
+	case answer := <-answerChan:
+		return signaller.punchCandidates(answer)
+	case <-timeout:
+		return nil, errors.New("peer did not answer the offer")
+	}
+}
+
+// Close logs out.
+func (signaller *Signaller) Close() error {
+	return signaller.client.Close()
+}
+
+// serve receives offers. Answers are routed to Connect, offers are answered and punched.
+func (signaller *Signaller) serve() {
+	for {
+		from, bytes, err := signaller.client.ReceiveOffer()
+		if err != nil {
+			log.Printf("xmpp signalling stopped: %s\n", err)
+			return
+		}
+		var offer Offer
+		if err = signaller.verify(&offer, bytes); err != nil {
+			log.Printf("dropped an offer from %s: %s\n", from, err)
+			continue
+		}
+		if offer.IsAnswer {
+			signaller.lock.Lock()
+			answerChan, isExist := signaller.answers[from.Bare()]
+			signaller.lock.Unlock()
+			if isExist {
+				select {
+				case answerChan <- &offer:
+				default:
+				}
+			}
+			continue
+		}
+		// Anyone could send an offer, which makes local node punch its candidates. Thus offers are only taken
+		// from contacts which have responded, and a few at a time.
+		if !signaller.server.KBuckets.respondedContact(offer.NodeID) {
+			log.Printf("dropped an offer from %s: not a responded contact\n", from)
+			continue
+		}
+		select {
+		case signaller.offers <- struct{}{}:
+		default:
+			log.Printf("dropped an offer from %s: too many offers\n", from)
+			continue
+		}
+		if !signaller.server.spawn(func() {
+			defer func() { <-signaller.offers }()
+			if err := signaller.client.SendOffer(from, signaller.newOffer(true).DumpSigned(signaller.key)); err != nil {
+				return
+			}
+			signaller.punchCandidates(&offer)
+		}) {
+			<-signaller.offers
+		}
+	}
+}
+
+// verify loads an offer, checking its signature, freshness and pinned key.
+func (signaller *Signaller) verify(offer *Offer, bytes []byte) error {
+	if err := offer.LoadsVerified(bytes); err != nil {
+		return err
+	}
+	age := signaller.server.Clock.Now().Sub(time.Unix(0, int64(offer.Timestamp)))
+	if age > seconds(signaller.server.config.SignalTimeout) || age < -seconds(signaller.server.config.SignalTimeout) {
+		return errors.New("offer expired")
+	}
+	trusted, err := signaller.pins.Check(offer.NodeID, offer.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return errors.New("offer signed by a key other than the pinned one")
+	}
+	return nil
+}
+
+// newOffer creates an offer with local candidates: the public address and addresses of local interfaces.
+func (signaller *Signaller) newOffer(isAnswer bool) *Offer {
+	self := signaller.server.KBuckets.SelfNode()
+	offer := &Offer{IsAnswer: isAnswer, NodeID: self.ID, Timestamp: uint64(signaller.server.Clock.Now().UnixNano())}
+	publicAddr, ok := self.Address.(*net.UDPAddr)
+	if ok && !publicAddr.IP.IsUnspecified() {
+		offer.Candidates = append(offer.Candidates, publicAddr)
+	}
+	localAddr, ok := signaller.server.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return offer
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.IsGlobalUnicast() {
+			offer.Candidates = append(offer.Candidates, &net.UDPAddr{IP: ipNet.IP, Port: localAddr.Port})
+		}
+	}
+	return offer
+}
+
+// punchCandidates punches all candidates of an offer at the same time and returns the first one opened.
+func (signaller *Signaller) punchCandidates(offer *Offer) (*Node, error) {
+	if len(offer.Candidates) == 0 {
+		return nil, errors.New("offer carries no candidate")
+	}
+	opened := make(chan *Node, len(offer.Candidates))
+	var wg sync.WaitGroup
+	for _, candidate := range offer.Candidates {
+		wg.Add(1)
+		go func(peer *Node) {
+			defer wg.Done()
+			if signaller.server.punch(peer) {
+				opened <- peer
+			}
+		}(&Node{ID: offer.NodeID, Address: candidate})
+	}
+	go func() {
+		wg.Wait()
+		close(opened)
+	}()
+	peer, ok := <-opened
+	if !ok {
+		return nil, errors.New("hole punching failed on all candidates")
+	}
+	return peer, nil
+}
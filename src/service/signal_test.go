@@ -0,0 +1,230 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// xmppStandIn is a local XMPP server just capable of what XMPPClient uses: plain authentication accepting any
+// password, resource binding, and routing messages between bound clients by bare JID.
+type xmppStandIn struct {
+	listener net.Listener
+	clients  map[JIDAddr]net.Conn
+	lock     *sync.Mutex
+}
+
+// newXMPPStandIn listens on loopback and serves until the test ends.
+func newXMPPStandIn(t *testing.T) *xmppStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	standIn := &xmppStandIn{listener, make(map[JIDAddr]net.Conn), &sync.Mutex{}}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go standIn.serve(conn)
+		}
+	}()
+	return standIn
+}
+
+// account returns an account of user on the stand-in.
+func (standIn *xmppStandIn) account(user string) *XMPPAccount {
+	return &XMPPAccount{JID: user + "@localhost", Password: "secret", Server: standIn.listener.Addr().String(), AllowPlain: true}
+}
+
+// serve logs a client in, then forwards its messages.
+func (standIn *xmppStandIn) serve(conn net.Conn) {
+	decoder, err := standIn.openStream(conn, fmt.Sprintf(`<mechanisms xmlns='%s'><mechanism>PLAIN</mechanism></mechanisms>`, nsSASL))
+	if err != nil {
+		return
+	}
+	var auth struct {
+		Value []byte `xml:",chardata"`
+	}
+	if standIn.decode(decoder, &auth) != nil {
+		return
+	}
+	credentials, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(auth.Value)))
+	fields := strings.Split(string(credentials), "\x00")
+	if err != nil || len(fields) != 3 {
+		return
+	}
+	user := fields[1]
+	io.WriteString(conn, fmt.Sprintf(`<success xmlns='%s'/>`, nsSASL))
+
+	if decoder, err = standIn.openStream(conn, fmt.Sprintf(`<bind xmlns='%s'/>`, nsBind)); err != nil {
+		return
+	}
+	if standIn.decode(decoder, &struct{}{}) != nil {
+		return
+	}
+	jid := JIDAddr(user + "@localhost/rumor")
+	io.WriteString(conn, fmt.Sprintf(`<iq type='result' id='bind1'><bind xmlns='%s'><jid>%s</jid></bind></iq>`, nsBind, jid))
+	standIn.lock.Lock()
+	standIn.clients[jid.Bare()] = conn
+	standIn.lock.Unlock()
+
+	for {
+		start, err := nextStart(decoder)
+		if err != nil {
+			return
+		}
+		if start.Name.Local != "message" {
+			decoder.Skip()
+			continue
+		}
+		var msg xmppMessage
+		if decoder.DecodeElement(&msg, &start) != nil {
+			return
+		}
+		msg.From = string(jid)
+		standIn.lock.Lock()
+		to := standIn.clients[JIDAddr(msg.To).Bare()]
+		standIn.lock.Unlock()
+		if bytes, err := xml.Marshal(&msg); err == nil && to != nil {
+			to.Write(bytes)
+		}
+	}
+}
+
+// openStream reads a stream header and answers it with features.
+func (standIn *xmppStandIn) openStream(conn net.Conn, features string) (*xml.Decoder, error) {
+	decoder := xml.NewDecoder(conn)
+	if _, err := nextStart(decoder); err != nil {
+		return nil, err
+	}
+	_, err := io.WriteString(conn, fmt.Sprintf(`<stream:stream from='localhost' version='1.0' xmlns='%s' xmlns:stream='%s'><stream:features>%s</stream:features>`,
+		nsClient, nsStreams, features))
+	return decoder, err
+}
+
+// decode decodes the next element into v.
+func (standIn *xmppStandIn) decode(decoder *xml.Decoder, v interface{}) error {
+	start, err := nextStart(decoder)
+	if err != nil {
+		return err
+	}
+	return decoder.DecodeElement(v, &start)
+}
+
+// nextStart returns the next start element.
+func nextStart(decoder *xml.Decoder) (xml.StartElement, error) {
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start, nil
+		}
+	}
+}
+
+// newSignallingPair starts two public servers signalling through a stand-in, with pins of the first one.
+func newSignallingPair(t *testing.T, pins *KeyPins) (*Signaller, *Signaller) {
+	standIn := newXMPPStandIn(t)
+	network := NewMemNetwork(1)
+	var signallers []*Signaller
+	for i, user := range []string{"alice", "bob"} {
+		server := newMemServer(t, network, &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i+1)), Port: 54321}, nil)
+		server.config.SignalTimeout = 1
+		signaller, err := NewSignaller(server, standIn.account(user), nil, pins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signallers = append(signallers, signaller)
+		pins = nil
+	}
+	return signallers[0], signallers[1]
+}
+
+// meet makes a signaller's server know the other's as a contact which has responded, so that its offers are taken.
+func meet(t *testing.T, signaller, other *Signaller) {
+	node := other.server.KBuckets.SelfNode()
+	signaller.server.KBuckets.Add(node.ID, node.Address)
+	if !signaller.server.Ping(node) {
+		t.Fatal("contact did not respond")
+	}
+}
+
+func TestSignallerConnect(t *testing.T) {
+	pins := NewKeyPins()
+	alice, bob := newSignallingPair(t, pins)
+	meet(t, bob, alice)
+	bobID := bob.server.KBuckets.Self.ID
+	peer, err := alice.Connect("bob@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *peer.ID != *bobID || alice.server.KBuckets.Get(bobID) == nil {
+		t.Fatalf("connected to %s, want bob", peer)
+	}
+	if !pins.Pinned(bobID).Equal(bob.key.Public().(ed25519.PublicKey)) {
+		t.Fatal("bob's key is not pinned")
+	}
+	endpoints := alice.server.KBuckets.SelfNode().Endpoints
+	if len(endpoints) == 0 || endpoints[len(endpoints)-1].Address != JIDAddr("alice@localhost") {
+		t.Fatalf("jid is not advertised: %v", endpoints)
+	}
+}
+
+func TestSignallerRejectsImpersonation(t *testing.T) {
+	pins := NewKeyPins()
+	alice, bob := newSignallingPair(t, pins)
+	// Bob's NodeID is pinned to another key, as if somebody else had claimed it first.
+	public, _, _ := ed25519.GenerateKey(nil)
+	pins.Check(bob.server.KBuckets.Self.ID, public)
+	meet(t, bob, alice)
+	if peer, err := alice.Connect("bob@localhost"); err == nil {
+		t.Fatalf("connected to %s signed by an unpinned key", peer)
+	}
+}
+
+func TestSignallerDropsOffersFromStrangers(t *testing.T) {
+	alice, bob := newSignallingPair(t, nil)
+	// Bob has never heard from alice, whose offer could make him punch any address.
+	if peer, err := alice.Connect("bob@localhost"); err == nil {
+		t.Fatalf("connected to %s through an offer from a stranger", peer)
+	}
+	if bob.server.KBuckets.Get(alice.server.KBuckets.Self.ID) != nil {
+		t.Fatal("bob punched alice's candidates")
+	}
+}
+
+func TestKeyPinsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_keys")
+	pins, err := LoadKeyPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := NewRandNodeID()
+	key, other := make(ed25519.PublicKey, ed25519.PublicKeySize), make(ed25519.PublicKey, ed25519.PublicKeySize)
+	other[0] = 1
+	if trusted, err := pins.Check(id, key); !trusted || err != nil {
+		t.Fatalf("first contact is not trusted: %v", err)
+	}
+	if pins, err = LoadKeyPins(path); err != nil {
+		t.Fatal(err)
+	}
+	if trusted, _ := pins.Check(id, other); trusted {
+		t.Fatal("another key is trusted after reloading")
+	}
+	if trusted, _ := pins.Check(id, key); !trusted {
+		t.Fatal("pinned key is not trusted after reloading")
+	}
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// STUN message types and attributes used here, see RFC 5389.
+const (
+	stunMagicCookie   uint32 = 0x2112A442
+	stunHeaderLength  int    = 20
+	stunBindingReq    uint16 = 0x0001
+	stunBindingRes    uint16 = 0x0101
+	stunBindingErrRes uint16 = 0x0111
+
+	stunAttrMappedAddress    uint16 = 0x0001
+	stunAttrXorMappedAddress uint16 = 0x0020
+)
+
+// STUNTransactionID identifies a STUN transaction.
+type STUNTransactionID [12]byte
+
+// stunMessage is a parsed STUN message. Only the attributes concerned are kept.
+type stunMessage struct {
+	Type          uint16
+	TransactionID STUNTransactionID
+	Attributes    map[uint16][]byte
+}
+
+// IsSTUNMessage tells whether a packet is a STUN message rather than a rumor datagram.
+// A STUN message starts with two zero bits, carries the magic cookie and a length matching the packet.
+func IsSTUNMessage(bytes []byte) bool {
+	if len(bytes) < stunHeaderLength || bytes[0]&0xC0 != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint32(bytes[4:8]) != stunMagicCookie {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(bytes[2:4]))+stunHeaderLength == len(bytes)
+}
+
+// loadSTUNMessage parses a STUN message. If illegal, return nil.
+func loadSTUNMessage(bytes []byte) *stunMessage {
+	if !IsSTUNMessage(bytes) {
+		return nil
+	}
+	msg := &stunMessage{Type: binary.BigEndian.Uint16(bytes[0:2]), Attributes: make(map[uint16][]byte)}
+	copy(msg.TransactionID[:], bytes[8:20])
+	p := stunHeaderLength
+	for p+4 <= len(bytes) {
+		attrType := binary.BigEndian.Uint16(bytes[p : p+2])
+		attrLength := int(binary.BigEndian.Uint16(bytes[p+2 : p+4]))
+		p += 4
+		if p+attrLength > len(bytes) {
+			return nil
+		}
+		value := make([]byte, attrLength)
+		copy(value, bytes[p:p+attrLength])
+		if _, isExist := msg.Attributes[attrType]; !isExist {
+			msg.Attributes[attrType] = value
+		}
+		p += (attrLength + 3) &^ 3 // Attributes are padded to 4 bytes.
+	}
+	return msg
+}
+
+// dumps dumps a STUN message. Attributes are written in ascending order of type.
+func (msg *stunMessage) dumps() []byte {
+	var types []uint16
+	length := 0
+	for attrType, value := range msg.Attributes {
+		types = append(types, attrType)
+		length += 4 + (len(value)+3)&^3
+	}
+	for i := 1; i < len(types); i++ {
+		for j := i; j > 0 && types[j] < types[j-1]; j-- {
+			types[j], types[j-1] = types[j-1], types[j]
+		}
+	}
+
+	buffer := make([]byte, stunHeaderLength+length)
+	binary.BigEndian.PutUint16(buffer[0:2], msg.Type)
+	binary.BigEndian.PutUint16(buffer[2:4], uint16(length))
+	binary.BigEndian.PutUint32(buffer[4:8], stunMagicCookie)
+	copy(buffer[8:20], msg.TransactionID[:])
+	p := stunHeaderLength
+	for _, attrType := range types {
+		value := msg.Attributes[attrType]
+		binary.BigEndian.PutUint16(buffer[p:p+2], attrType)
+		binary.BigEndian.PutUint16(buffer[p+2:p+4], uint16(len(value)))
+		copy(buffer[p+4:], value)
+		p += 4 + (len(value)+3)&^3
+	}
+	return buffer
+}
+
+// dumpSTUNAddress dumps an address attribute value. XOR-ed if transaction ID is given.
+// | Reserved | Family | Port | IP 4/16 |
+func dumpSTUNAddress(addr *net.UDPAddr, tid *STUNTransactionID) []byte {
+	var value []byte
+	if ip := addr.IP.To4(); ip != nil {
+		value = make([]byte, 4+net.IPv4len)
+		value[1] = 0x01
+		copy(value[4:], ip)
+	} else {
+		value = make([]byte, 4+net.IPv6len)
+		value[1] = 0x02
+		copy(value[4:], addr.IP.To16())
+	}
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	if tid != nil {
+		xorSTUNAddress(value, tid)
+	}
+	return value
+}
+
+// loadSTUNAddress loads an address attribute value. XOR-ed if transaction ID is given.
+func loadSTUNAddress(value []byte, tid *STUNTransactionID) *net.UDPAddr {
+	if len(value) != 4+net.IPv4len && len(value) != 4+net.IPv6len {
+		return nil
+	}
+	if (value[1] == 0x01) != (len(value) == 4+net.IPv4len) {
+		return nil
+	}
+	value = append([]byte{}, value...)
+	if tid != nil {
+		xorSTUNAddress(value, tid)
+	}
+	ip := make(net.IP, len(value)-4)
+	copy(ip, value[4:])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(value[2:4]))}
+}
+
+// xorSTUNAddress XORs port with the magic cookie's high 16 bits and IP with magic cookie + transaction ID.
+func xorSTUNAddress(value []byte, tid *STUNTransactionID) {
+	var mask [16]byte
+	binary.BigEndian.PutUint32(mask[:4], stunMagicCookie)
+	copy(mask[4:], tid[:])
+	value[2] ^= mask[0]
+	value[3] ^= mask[1]
+	for i := 4; i < len(value); i++ {
+		value[i] ^= mask[i-4]
+	}
+}
+
+// STUNClient sends STUN binding requests through a shared PacketConn.
+// Responses should be fed by the owner of the conn via Handle.
+type STUNClient struct {
+	conn         net.PacketConn
+	clock        Clock // Measures timeouts and round trips.
+	transactions map[STUNTransactionID]chan *stunMessage
+	lock         *sync.Mutex
+}
+
+// NewSTUNClient creates a STUN client over a conn which is read by others.
+func NewSTUNClient(conn net.PacketConn, clock Clock) *STUNClient {
+	return &STUNClient{conn, clock, make(map[STUNTransactionID]chan *stunMessage), &sync.Mutex{}}
+}
+
+// Handle routes an incoming STUN response to its transaction. Return false if nobody waits for it.
+func (client *STUNClient) Handle(bytes []byte) bool {
+	msg := loadSTUNMessage(bytes)
+	if msg == nil {
+		return false
+	}
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	channel, isExist := client.transactions[msg.TransactionID]
+	if !isExist {
+		return false
+	}
+	delete(client.transactions, msg.TransactionID)
+	channel <- msg
+	return true
+}
+
+// Binding sends a binding request to a STUN server and returns the mapped address.
+// Requests are retransmitted with doubling intervals starting at 500ms until timeout.
+func (client *STUNClient) Binding(server net.Addr, timeout time.Duration) (*net.UDPAddr, error) {
+	msg, err := client.roundTrip(server, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if addr := mappedAddress(msg); addr != nil {
+		return addr, nil
+	}
+	return nil, errors.New("stun response carries no mapped address")
+}
+
+// roundTrip sends a binding request with extra attributes and waits for its response.
+func (client *STUNClient) roundTrip(server net.Addr, attrs map[uint16][]byte, timeout time.Duration) (*stunMessage, error) {
+	req := &stunMessage{Type: stunBindingReq, Attributes: attrs}
+	if req.Attributes == nil {
+		req.Attributes = make(map[uint16][]byte)
+	}
+	if _, err := rand.Read(req.TransactionID[:]); err != nil {
+		return nil, err
+	}
+	resChan := make(chan *stunMessage, 1)
+	client.lock.Lock()
+	client.transactions[req.TransactionID] = resChan
+	client.lock.Unlock()
+	defer func() {
+		client.lock.Lock()
+		delete(client.transactions, req.TransactionID)
+		client.lock.Unlock()
+	}()
+
+	bytes := req.dumps()
+	deadline, deadlineTimer := after(client.clock, timeout)
+	defer deadlineTimer.Stop()
+	rto := 500 * time.Millisecond
+	for {
+		if _, err := client.conn.WriteTo(bytes, server); err != nil {
+			return nil, err
+		}
+		retransmit, retransmitTimer := after(client.clock, rto)
+		select {
+		case res := <-resChan:
+			retransmitTimer.Stop()
+			if res.Type != stunBindingRes {
+				return nil, fmt.Errorf("stun server %s rejected the request", server)
+			}
+			return res, nil
+		case <-retransmit:
+			rto *= 2
+		case <-deadline:
+			retransmitTimer.Stop()
+			return nil, fmt.Errorf("stun server %s timed out", server)
+		}
+	}
+}
+
+// HandleSTUNRequest answers a binding request with the observed address of its sender.
+// With it every node could serve as a STUN server for others. Return false if it is not a binding request.
+func HandleSTUNRequest(conn net.PacketConn, bytes []byte, addr net.Addr) bool {
+	req := loadSTUNMessage(bytes)
+	if req == nil || req.Type != stunBindingReq {
+		return false
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	res := &stunMessage{Type: stunBindingRes, TransactionID: req.TransactionID, Attributes: map[uint16][]byte{
+		stunAttrXorMappedAddress: dumpSTUNAddress(udpAddr, &req.TransactionID),
+	}}
+	conn.WriteTo(res.dumps(), addr)
+	return true
+}
+
+// ServeSTUN serves as a plain STUN server on conn until the conn is closed.
+func ServeSTUN(conn net.PacketConn) error {
+	var buffer [MaxPackageSize]byte
+	for {
+		n, addr, err := conn.ReadFrom(buffer[:])
+		if err != nil {
+			return err
+		}
+		HandleSTUNRequest(conn, buffer[:n], addr)
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveSTUNClient feeds packets read from conn to client until conn is closed.
+func serveSTUNClient(conn net.PacketConn, client *STUNClient) {
+	var buffer [MaxPackageSize]byte
+	for {
+		n, _, err := conn.ReadFrom(buffer[:])
+		if err != nil {
+			return
+		}
+		client.Handle(buffer[:n])
+	}
+}
+
+func TestSTUNMessageRoundTrip(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(203, 0, 113, 7).To4(), Port: 54321},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3478},
+	} {
+		msg := &stunMessage{Type: stunBindingRes, TransactionID: STUNTransactionID{1, 2, 3}}
+		msg.Attributes = map[uint16][]byte{stunAttrXorMappedAddress: dumpSTUNAddress(addr, &msg.TransactionID)}
+		bytes := msg.dumps()
+		if !IsSTUNMessage(bytes) {
+			t.Fatalf("%s: dumped message is not recognized", addr)
+		}
+		loaded := loadSTUNMessage(bytes)
+		if loaded == nil || loaded.Type != stunBindingRes || loaded.TransactionID != msg.TransactionID {
+			t.Fatalf("%s: loaded %+v", addr, loaded)
+		}
+		if mapped := mappedAddress(loaded); !SameAddr(mapped, addr) {
+			t.Fatalf("mapped address %s, want %s", mapped, addr)
+		}
+	}
+}
+
+func TestIsSTUNMessageRejectsDatagram(t *testing.T) {
+	datagram := NewDatagram(SystemClock, Ping, true, nil, &Node{ID: NewRandNodeID()}, NewPing(nil))
+	if IsSTUNMessage(datagram.Dumps()) {
+		t.Fatal("datagram is taken as a stun message")
+	}
+}
+
+func TestSTUNBindingBehindNAT(t *testing.T) {
+	network := NewMemNetwork(1)
+	serverConn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 3478}, nil)
+	defer serverConn.Close()
+	go ServeSTUN(serverConn)
+	nat, _ := network.NewNAT(NATPortRestricted, net.IPv4(203, 0, 113, 1), 0)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 5000}, nat)
+	defer conn.Close()
+	client := NewSTUNClient(conn, SystemClock)
+	go serveSTUNClient(conn, client)
+
+	addr, err := client.Binding(serverConn.LocalAddr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !addr.IP.Equal(nat.IP) || addr.Port == 5000 {
+		t.Fatalf("mapped address %s, want one on %s", addr, nat.IP)
+	}
+}
+
+func TestSTUNBindingTimeout(t *testing.T) {
+	network := NewMemNetwork(1)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 5000}, nil)
+	defer conn.Close()
+	client := NewSTUNClient(conn, SystemClock)
+	go serveSTUNClient(conn, client)
+
+	start := time.Now()
+	if _, err := client.Binding(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 3), Port: 3478}, 200*time.Millisecond); err == nil {
+		t.Fatal("binding succeeded without a server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("binding gave up after %s", elapsed)
+	}
+}
+
+func TestDetectPublicAddrInBackground(t *testing.T) {
+	network := NewMemNetwork(1)
+	stunConn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 3478}, nil)
+	defer stunConn.Close()
+	nat, _ := network.NewNAT(NATPortRestricted, net.IPv4(203, 0, 113, 1), 0)
+	conn, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nat)
+
+	cfg := DefaultConfig()
+	cfg.PortMapping = false
+	cfg.STUNServers = []string{stunConn.LocalAddr().String()}
+	cfg.STUNTimeout = 1
+	server := NewServerOn(NewBucketTree(cfg), cfg, SystemClock, conn)
+	defer server.Stop(context.Background())
+
+	// Nothing answers at first, StartService must not wait for it.
+	start := time.Now()
+	server.StartService()
+	if elapsed := time.Since(start); elapsed > seconds(cfg.STUNTimeout)/2 {
+		t.Fatalf("StartService blocked for %s", elapsed)
+	}
+	go ServeSTUN(stunConn)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if addr, ok := server.KBuckets.SelfNode().Address.(*net.UDPAddr); ok && addr.IP.Equal(nat.IP) {
+			return
+		}
+	}
+	t.Fatalf("public address not detected, self is %s", server.KBuckets.SelfNode().Address)
+}
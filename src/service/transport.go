@@ -0,0 +1,352 @@
+package service
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+In-memory transport:
+A MemNetwork carries packets between MemConns without sockets, so that many servers run in one process and
+faults are injected at will. MemConn implements net.PacketConn, see NewServerOn.
+
+Every packet is delayed by Latency plus a random Jitter, measured by the network's Clock. It is lost with probability Loss, or held back by
+another ReorderDelay with probability Reorder, so that later packets overtake it. These random decisions follow the
+seed, the two addresses and how many packets went between them before, so that a run is reproduced no matter
+which goroutine sends first.
+
+A MemConn listens either on a public address, or on a private address behind a MemNAT, which maps it to the
+NAT's public IP as the NAT type says:
+	full-cone         One mapping per private address, anyone may send through it.
+	restricted        One mapping per private address, only IPs sent to may send back.
+	port-restricted   One mapping per private address, only addresses sent to may send back.
+	symmetric         One mapping per private and remote address pair, only that remote address may send back.
+Idle mappings expire after the NAT's Lifetime. Private addresses are unreachable, even behind the same NAT.
+*/
+
+// memQueueLength sets how many packets wait for a MemConn reader, further ones are dropped.
+const memQueueLength = 256
+
+// memEphemeralPort is the first port picked for a MemConn listening on port 0.
+const memEphemeralPort = 49152
+
+// MemNetwork is an in-memory network of MemConns.
+type MemNetwork struct {
+	Clock   Clock
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+	Reorder float64
+
+	ReorderDelay time.Duration // How long reordered packets are held back.
+
+	conns map[string]*MemConn // By local address.
+	nats  map[string]*MemNAT  // By public IP.
+	seed  int64
+	flows map[string]uint64 // Packets sent so far by source and destination address.
+	lock  sync.Mutex
+}
+
+// MemNAT is a NAT gateway on a MemNetwork.
+type MemNAT struct {
+	Type     NATType
+	IP       net.IP
+	Lifetime time.Duration // Idle mappings expire after it, 0 means never.
+
+	nextPort int
+	mappings map[string]*memMapping // By private address, and remote address if symmetric.
+	ports    map[int]*memMapping    // By public port.
+}
+
+type memMapping struct {
+	private  *net.UDPAddr
+	public   *net.UDPAddr
+	permits  map[string]bool // Remote IPs or addresses allowed to send back, depending on the NAT type.
+	lastSent time.Time
+}
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// NewMemNetwork creates a network without delay or loss. Random decisions follow seed.
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{Clock: SystemClock, conns: make(map[string]*MemConn), nats: make(map[string]*MemNAT), seed: seed,
+		flows: make(map[string]uint64)}
+}
+
+// NewNAT adds a NAT gateway with a public IP.
+func (network *MemNetwork) NewNAT(natType NATType, ip net.IP, lifetime time.Duration) (*MemNAT, error) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if _, isExist := network.nats[ip.String()]; isExist {
+		return nil, errors.New("nat ip already in use")
+	}
+	nat := &MemNAT{Type: natType, IP: ip, Lifetime: lifetime, nextPort: 10000, mappings: make(map[string]*memMapping), ports: make(map[int]*memMapping)}
+	network.nats[ip.String()] = nat
+	return nat, nil
+}
+
+// Listen creates a MemConn on addr. If nat is not nil, addr is a private address behind it.
+// A free port is picked if addr has port 0.
+func (network *MemNetwork) Listen(addr *net.UDPAddr, nat *MemNAT) (*MemConn, error) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if addr.Port == 0 {
+		addr = &net.UDPAddr{IP: addr.IP, Port: memEphemeralPort}
+		for network.conns[addr.String()] != nil {
+			addr.Port++
+		}
+	}
+	if _, isExist := network.conns[addr.String()]; isExist {
+		return nil, errors.New("address already in use")
+	}
+	conn := &MemConn{network: network, addr: addr, nat: nat, queue: make(chan memPacket, memQueueLength),
+		closed: make(chan struct{}), wake: make(chan struct{})}
+	network.conns[addr.String()] = conn
+	return conn, nil
+}
+
+// send translates the source address, then delivers a packet after a random delay unless it is lost.
+func (network *MemNetwork) send(conn *MemConn, data []byte, to *net.UDPAddr) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	from := conn.addr
+	if conn.nat != nil {
+		from = conn.nat.outbound(conn.addr, to, network.Clock.Now())
+	}
+	flow := conn.addr.String() + "->" + to.String()
+	random := rand.New(newFlowSource(network.seed, flow, network.flows[flow]))
+	network.flows[flow]++
+	if random.Float64() < network.Loss {
+		return
+	}
+	delay := network.Latency
+	if network.Jitter > 0 {
+		delay += time.Duration(random.Int63n(int64(network.Jitter)))
+	}
+	if random.Float64() < network.Reorder {
+		delay += network.ReorderDelay
+	}
+	packet := memPacket{append([]byte{}, data...), from}
+	network.Clock.AfterFunc(delay, func() {
+		network.deliver(packet, to)
+	})
+}
+
+// flowSource is a splitmix64 generator for the n-th packet of a flow, cheap enough to be created for every packet.
+type flowSource uint64
+
+func newFlowSource(seed int64, flow string, n uint64) *flowSource {
+	hash := fnv.New64a()
+	hash.Write([]byte(flow))
+	source := flowSource(uint64(seed) ^ hash.Sum64() ^ n*0x9e3779b97f4a7c15)
+	source.Uint64() // Spreads seeds which differ in a few bits.
+	return &source
+}
+
+func (source *flowSource) Uint64() uint64 {
+	*source += 0x9e3779b97f4a7c15
+	z := uint64(*source)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (source *flowSource) Int63() int64 {
+	return int64(source.Uint64() >> 1)
+}
+
+func (source *flowSource) Seed(seed int64) {
+	*source = flowSource(seed)
+}
+
+// deliver queues a packet to the MemConn on to, or to the private one behind a NAT.
+func (network *MemNetwork) deliver(packet memPacket, to *net.UDPAddr) {
+	network.lock.Lock()
+	conn, isExist := network.conns[to.String()]
+	if !isExist || conn.nat != nil {
+		conn = nil
+		if nat, isExist := network.nats[to.IP.String()]; isExist {
+			if private := nat.inbound(packet.from.(*net.UDPAddr), to, network.Clock.Now()); private != nil {
+				conn = network.conns[private.String()]
+			}
+		}
+	}
+	network.lock.Unlock()
+	if conn == nil {
+		return
+	}
+	select {
+	case conn.queue <- packet:
+	default:
+	}
+}
+
+// remove detaches a closed MemConn.
+func (network *MemNetwork) remove(conn *MemConn) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if network.conns[conn.addr.String()] == conn {
+		delete(network.conns, conn.addr.String())
+	}
+}
+
+// outbound returns the public address of a packet from private to remote, creating the mapping if needed.
+func (nat *MemNAT) outbound(private, remote *net.UDPAddr, now time.Time) *net.UDPAddr {
+	key := private.String()
+	if nat.Type == NATSymmetric {
+		key += "->" + remote.String()
+	}
+	mapping, isExist := nat.mappings[key]
+	if isExist && nat.expired(mapping, now) {
+		delete(nat.mappings, key)
+		delete(nat.ports, mapping.public.Port)
+		isExist = false
+	}
+	if !isExist {
+		mapping = &memMapping{private: private, public: &net.UDPAddr{IP: nat.IP, Port: nat.nextPort}, permits: make(map[string]bool)}
+		nat.nextPort++
+		nat.mappings[key] = mapping
+		nat.ports[mapping.public.Port] = mapping
+	}
+	mapping.lastSent = now
+	switch nat.Type {
+	case NATRestricted:
+		mapping.permits[remote.IP.String()] = true
+	case NATPortRestricted, NATSymmetric:
+		mapping.permits[remote.String()] = true
+	}
+	return mapping.public
+}
+
+// inbound returns the private address a packet from remote to public goes to, nil if filtered.
+func (nat *MemNAT) inbound(remote, public *net.UDPAddr, now time.Time) *net.UDPAddr {
+	mapping, isExist := nat.ports[public.Port]
+	if !isExist || nat.expired(mapping, now) {
+		return nil
+	}
+	switch nat.Type {
+	case NATFullCone:
+		return mapping.private
+	case NATRestricted:
+		if mapping.permits[remote.IP.String()] {
+			return mapping.private
+		}
+	case NATPortRestricted, NATSymmetric:
+		if mapping.permits[remote.String()] {
+			return mapping.private
+		}
+	}
+	return nil
+}
+
+func (nat *MemNAT) expired(mapping *memMapping, now time.Time) bool {
+	return nat.Lifetime > 0 && now.Sub(mapping.lastSent) > nat.Lifetime
+}
+
+// MemConn is an endpoint on a MemNetwork. It implements net.PacketConn.
+type MemConn struct {
+	network *MemNetwork
+	addr    *net.UDPAddr
+	nat     *MemNAT
+	queue   chan memPacket
+	closed  chan struct{}
+
+	deadline time.Time
+	wake     chan struct{} // Closed and renewed whenever the deadline changes.
+	lock     sync.Mutex
+}
+
+// ReadFrom reads a packet. Bytes beyond len(b) are discarded.
+func (conn *MemConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn.lock.Lock()
+		deadline, wake := conn.deadline, conn.wake
+		conn.lock.Unlock()
+		var timeout <-chan time.Time // Nil if no deadline.
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case packet := <-conn.queue:
+			stopTimer(timer)
+			return copy(b, packet.data), packet.from, nil
+		case <-conn.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-wake:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// WriteTo sends a packet to a UDP address on the network.
+func (conn *MemConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("memory network only carries udp addresses")
+	}
+	conn.network.send(conn, b, to)
+	return len(b), nil
+}
+
+// Close detaches the MemConn from the network and wakes up readers.
+func (conn *MemConn) Close() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	select {
+	case <-conn.closed:
+		return net.ErrClosed
+	default:
+	}
+	close(conn.closed)
+	conn.network.remove(conn)
+	return nil
+}
+
+// LocalAddr returns the address the MemConn listens on, which is a private one behind a NAT.
+func (conn *MemConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+// SetDeadline sets the read deadline, writes never block.
+func (conn *MemConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, a zero value means no deadline.
+func (conn *MemConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.deadline = t
+	close(conn.wake)
+	conn.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing since writes never block.
+func (conn *MemConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
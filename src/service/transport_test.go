@@ -0,0 +1,158 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// received drains the packets queued on a MemConn without blocking.
+func received(conn *MemConn) []memPacket {
+	var packets []memPacket
+	for {
+		select {
+		case packet := <-conn.queue:
+			packets = append(packets, packet)
+		default:
+			return packets
+		}
+	}
+}
+
+func TestMemNetworkDelivery(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		configure func(network *MemNetwork)
+		minCount  int // Packets delivered out of 100.
+		maxCount  int
+		minDelay  time.Duration // Measured to the next millisecond.
+		maxDelay  time.Duration
+		reordered bool
+	}{
+		{"latency", func(network *MemNetwork) { network.Latency = 20 * time.Millisecond },
+			100, 100, 20 * time.Millisecond, 20 * time.Millisecond, false},
+		{"jitter", func(network *MemNetwork) { network.Latency, network.Jitter = 20*time.Millisecond, 10*time.Millisecond },
+			100, 100, 20 * time.Millisecond, 30 * time.Millisecond, true},
+		{"loss", func(network *MemNetwork) { network.Loss = 0.3 },
+			50, 90, time.Millisecond, time.Millisecond, false},
+		{"reordering", func(network *MemNetwork) { network.Reorder, network.ReorderDelay = 0.3, 10*time.Millisecond },
+			100, 100, time.Millisecond, 11 * time.Millisecond, true},
+		{"reordering without delay", func(network *MemNetwork) { network.Reorder = 0.3 },
+			100, 100, time.Millisecond, time.Millisecond, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Unix(0, 0))
+			network := NewMemNetwork(1)
+			network.Clock = clock
+			test.configure(network)
+			sender, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}, nil)
+			receiver, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+
+			// Packet i is sent at i milliseconds.
+			var order []int
+			minDelay, maxDelay := time.Hour, time.Duration(0)
+			for i := 0; i < 200; i++ {
+				if i < 100 {
+					sender.WriteTo([]byte{byte(i)}, receiver.LocalAddr())
+				}
+				clock.Advance(time.Millisecond)
+				for _, packet := range received(receiver) {
+					index := int(packet.data[0])
+					delay := time.Duration(i+1-index) * time.Millisecond
+					if delay < minDelay {
+						minDelay = delay
+					}
+					if delay > maxDelay {
+						maxDelay = delay
+					}
+					order = append(order, index)
+					if !SameAddr(packet.from, sender.LocalAddr()) {
+						t.Fatalf("packet from %s", packet.from)
+					}
+				}
+			}
+			if len(order) < test.minCount || len(order) > test.maxCount {
+				t.Fatalf("%d packets delivered", len(order))
+			}
+			if minDelay < test.minDelay || maxDelay > test.maxDelay {
+				t.Fatalf("delayed from %s to %s", minDelay, maxDelay)
+			}
+			reordered := false
+			for i := 1; i < len(order); i++ {
+				reordered = reordered || order[i] < order[i-1]
+			}
+			if reordered != test.reordered {
+				t.Fatalf("reordered: %t, order %v", reordered, order)
+			}
+		})
+	}
+}
+
+func TestMemNATFilters(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 54321}
+	for _, test := range []struct {
+		natType   NATType
+		samePort  bool // Whether the peer gets through from another port.
+		otherIP   bool // Whether another host gets through.
+		perRemote bool // Whether each remote address gets its own mapping.
+	}{
+		{NATFullCone, true, true, false},
+		{NATRestricted, true, false, false},
+		{NATPortRestricted, false, false, false},
+		{NATSymmetric, false, false, true},
+	} {
+		t.Run(test.natType.String(), func(t *testing.T) {
+			clock := NewFakeClock(time.Unix(0, 0))
+			network := NewMemNetwork(1)
+			network.Clock = clock
+			nat, _ := network.NewNAT(test.natType, net.IPv4(203, 0, 113, 1), time.Minute)
+			private, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 54321}, nat)
+			remote, _ := network.Listen(peer, nil)
+			remoteOtherPort, _ := network.Listen(&net.UDPAddr{IP: peer.IP, Port: 54322}, nil)
+			otherHost, _ := network.Listen(&net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 54321}, nil)
+
+			// The mapped address is learnt from what the peer receives.
+			mapped := func(to *MemConn) net.Addr {
+				private.WriteTo([]byte("out"), to.LocalAddr())
+				clock.Advance(time.Millisecond)
+				packets := received(to)
+				if len(packets) != 1 {
+					t.Fatalf("%d packets got out", len(packets))
+				}
+				return packets[0].from
+			}
+			public := mapped(remote)
+			if !public.(*net.UDPAddr).IP.Equal(nat.IP) {
+				t.Fatalf("mapped to %s", public)
+			}
+			reaches := func(from *MemConn) bool {
+				from.WriteTo([]byte("in"), public)
+				clock.Advance(time.Millisecond)
+				return len(received(private)) == 1
+			}
+			if !reaches(remote) {
+				t.Fatal("the peer sent to does not get through")
+			}
+			if got := reaches(remoteOtherPort); got != test.samePort {
+				t.Fatalf("the peer from another port gets through: %t", got)
+			}
+			if got := reaches(otherHost); got != test.otherIP {
+				t.Fatalf("another host gets through: %t", got)
+			}
+			if got := !SameAddr(mapped(otherHost), public); got != test.perRemote {
+				t.Fatalf("another remote address is mapped separately: %t", got)
+			}
+
+			// Private addresses are unreachable, and idle mappings expire.
+			remote.WriteTo([]byte("in"), private.LocalAddr())
+			clock.Advance(time.Millisecond)
+			if len(received(private)) != 0 {
+				t.Fatal("got through to a private address")
+			}
+			clock.Advance(2 * time.Minute)
+			if reaches(remote) {
+				t.Fatal("got through an expired mapping")
+			}
+		})
+	}
+}
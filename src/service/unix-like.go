@@ -2,18 +2,30 @@
 
 package service
 
-import "net"
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
 
-const pipePath string = `/tmp/rumor.sock`
+// pipePath returns the IPC socket path of an instance.
+func pipePath(home *Home) string {
+	return filepath.Join(home.Dir, "rumor.sock")
+}
 
 // NewNamedPipeListener creates a pipe listener on specific platform
-// On unix, it is substituted with Unix Domain Socket.
-func NewNamedPipeListener() (net.Listener, error) {
-	return net.Listen("unix", pipePath)
+// On unix, it is substituted with Unix Domain Socket. A socket left by a crashed instance is removed.
+func NewNamedPipeListener(home *Home) (net.Listener, error) {
+	if conn, err := net.Dial("unix", pipePath(home)); err == nil {
+		conn.Close()
+	} else {
+		os.Remove(pipePath(home))
+	}
+	return net.Listen("unix", pipePath(home))
 }
 
 // DialPipe dials a named pipe on specific platform.
 // On unix, it is substituted with Unix Domain Socket.
-func DialPipe() (net.Conn, error) {
-	return net.Dial("unix", pipePath)
+func DialPipe(home *Home) (net.Conn, error) {
+	return net.Dial("unix", pipePath(home))
 }
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// UPnP IGD services able to map ports.
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnPMapper maps ports by UPnP Internet Gateway Device.
+type UPnPMapper struct {
+	// Location is the URL of the device description. If empty, it is discovered by SSDP.
+	Location    string
+	Timeout     time.Duration // Timeout of every request.
+	controlURL  string
+	serviceType string
+	localIP     net.IP
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// Name returns the protocol name.
+func (mapper *UPnPMapper) Name() string {
+	return "UPnP IGD"
+}
+
+// AddMapping creates or renews a UDP mapping.
+func (mapper *UPnPMapper) AddMapping(localPort int, lifetime time.Duration) (*net.UDPAddr, time.Duration, error) {
+	if err := mapper.prepare(); err != nil {
+		return nil, 0, err
+	}
+	_, err := mapper.soap("AddPortMapping", fmt.Sprintf("<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort>"+
+		"<NewProtocol>UDP</NewProtocol><NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient>"+
+		"<NewEnabled>1</NewEnabled><NewPortMappingDescription>rumor</NewPortMappingDescription>"+
+		"<NewLeaseDuration>%d</NewLeaseDuration>", localPort, localPort, mapper.localIP, int(lifetime/time.Second)))
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := mapper.soap("GetExternalIPAddress", "")
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(xmlElementText(res, "NewExternalIPAddress")))
+	if ip == nil {
+		return nil, 0, errors.New("upnp gateway returned an illegal external ip")
+	}
+	return &net.UDPAddr{IP: ip, Port: localPort}, lifetime, nil
+}
+
+// DeleteMapping removes a UDP mapping.
+func (mapper *UPnPMapper) DeleteMapping(localPort int) error {
+	if err := mapper.prepare(); err != nil {
+		return err
+	}
+	_, err := mapper.soap("DeletePortMapping", fmt.Sprintf("<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>UDP</NewProtocol>", localPort))
+	return err
+}
+
+// prepare discovers the gateway and finds the control URL of a port mapping service.
+func (mapper *UPnPMapper) prepare() error {
+	if mapper.controlURL != "" {
+		return nil
+	}
+	if mapper.Location == "" {
+		location, err := discoverIGD(mapper.Timeout)
+		if err != nil {
+			return err
+		}
+		mapper.Location = location
+	}
+	client := &http.Client{Timeout: mapper.Timeout}
+	res, err := client.Get(mapper.Location)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var root upnpRoot
+	if err = xml.NewDecoder(res.Body).Decode(&root); err != nil {
+		return err
+	}
+	base, err := url.Parse(mapper.Location)
+	if err != nil {
+		return err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return err
+		}
+	}
+	serviceType, controlURL := findUPnPService(&root.Device)
+	if controlURL == "" {
+		return errors.New("upnp gateway offers no port mapping service")
+	}
+	control, err := base.Parse(controlURL)
+	if err != nil {
+		return err
+	}
+	// The internal client must be the local address facing the gateway.
+	conn, err := net.DialTimeout("tcp", base.Host, mapper.Timeout)
+	if err != nil {
+		return err
+	}
+	mapper.localIP = conn.LocalAddr().(*net.TCPAddr).IP
+	conn.Close()
+	mapper.serviceType, mapper.controlURL = serviceType, control.String()
+	return nil
+}
+
+// findUPnPService searches the device tree for a port mapping service.
+func findUPnPService(device *upnpDevice) (string, string) {
+	for _, serviceType := range upnpServiceTypes {
+		for _, service := range device.Services {
+			if service.ServiceType == serviceType {
+				return service.ServiceType, service.ControlURL
+			}
+		}
+	}
+	for i := range device.Devices {
+		if serviceType, controlURL := findUPnPService(&device.Devices[i]); controlURL != "" {
+			return serviceType, controlURL
+		}
+	}
+	return "", ""
+}
+
+// soap calls an action of the port mapping service and returns the response body.
+func (mapper *UPnPMapper) soap(action, arguments string) ([]byte, error) {
+	body := fmt.Sprintf(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">%s</u:%s></s:Body></s:Envelope>`,
+		action, mapper.serviceType, arguments, action)
+	req, err := http.NewRequest("POST", mapper.controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, mapper.serviceType, action))
+	client := &http.Client{Timeout: mapper.Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var buffer bytes.Buffer
+	buffer.ReadFrom(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp %s failed: %s %s", action, res.Status, strings.TrimSpace(xmlElementText(buffer.Bytes(), "errorDescription")))
+	}
+	return buffer.Bytes(), nil
+}
+
+// xmlElementText returns the text of the first element with the local name, ignoring namespaces.
+func xmlElementText(data []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var text string
+			decoder.DecodeElement(&text, &start)
+			return text
+		}
+	}
+}
+
+// discoverIGD finds the description URL of an internet gateway device by SSDP.
+func discoverIGD(timeout time.Duration) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	ssdpAddr := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(search), ssdpAddr); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return "", errors.New("no upnp gateway found")
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		res.Body.Close()
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
@@ -36,17 +36,51 @@ func NewRandCookie() *Cookie {
 }
 
 // DumpUDPAddr dumps UDPAddr.
-// Only IPv4 is supported yet.
+// IPv4 addresses (including IPv4-mapped IPv6 ones) take 6 bytes, IPv6 addresses take 18 bytes.
+// | IP 4/16 bytes | port 2 bytes |
 func DumpUDPAddr(addr *net.UDPAddr) []byte {
 	ip := addr.IP.To4()
 	if ip == nil {
+		ip = addr.IP.To16()
+		if ip == nil {
+			return nil
+		}
+	}
+	buffer := make([]byte, len(ip)+2)
+	copy(buffer, ip)
+	binary.LittleEndian.PutUint16(buffer[len(ip):], uint16(addr.Port))
+	return buffer
+}
+
+// LoadUDPAddr loads UDPAddr dumped by DumpUDPAddr. The family is decided by length.
+// If the length is illegal, return nil.
+func LoadUDPAddr(bytes []byte) *net.UDPAddr {
+	var ip net.IP
+	switch len(bytes) {
+	case net.IPv4len + 2:
+		ip = net.IPv4(bytes[0], bytes[1], bytes[2], bytes[3])
+	case net.IPv6len + 2:
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, bytes)
+	default:
 		return nil
 	}
-	// for future compatibility of IPv6
-	port := make([]byte, 2)
-	binary.LittleEndian.PutUint16(port, uint16(addr.Port))
-	ip = append(ip, port...)
-	return ip
+	port := int(binary.LittleEndian.Uint16(bytes[len(bytes)-2:]))
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+// SameAddr tells whether two addresses point to the same endpoint.
+// UDP addresses are compared by IP and port so that an IPv4 address equals its IPv4-mapped IPv6 form.
+func SameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	udpA, okA := a.(*net.UDPAddr)
+	udpB, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return udpA.IP.Equal(udpB.IP) && udpA.Port == udpB.Port
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
 }
 
 // CommonPrefixLength calcs the length of common prefix bits of two nodeID slices.
@@ -67,6 +101,16 @@ func CommonPrefixLength(a []byte, b []byte) int {
 	return count
 }
 
+// Closer tells whether a is closer to target than b by XOR distance.
+func Closer(a, b, target *NodeID) bool {
+	for i := range target {
+		if da, db := a[i]^target[i], b[i]^target[i]; da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
 // Min returns the smaller integer.
 func Min(a, b int) int {
 	if a > b {
@@ -75,11 +119,6 @@ func Min(a, b int) int {
 	return a
 }
 
-// DetectPublicAddr try to find local machine's public udp address by STUN.
-func DetectPublicAddr() net.Addr {
-	return &net.UDPAddr{}
-}
-
 // WelcomePrint prints welcome message when rumor service is successfully initialed
 func WelcomePrint() {
 	fmt.Println("===================================================")
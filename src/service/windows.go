@@ -3,19 +3,25 @@
 package service
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/Microsoft/go-winio"
 )
 
-const pipePath string = `\\.\pipe\RumorPipe`
+// pipePath returns the pipe name of an instance, which is derived from its home directory.
+func pipePath(home *Home) string {
+	return fmt.Sprintf(`\\.\pipe\RumorPipe-%x`, sha1.Sum([]byte(strings.ToLower(home.Dir))))
+}
 
 // NewNamedPipeListener creates a pipe listener on specific platform
-func NewNamedPipeListener() (net.Listener, error) {
-	return winio.ListenPipe(pipePath, nil)
+func NewNamedPipeListener(home *Home) (net.Listener, error) {
+	return winio.ListenPipe(pipePath(home), nil)
 }
 
 // DialPipe dials a named pipe on specific platform.
-func DialPipe() (net.Conn, error) {
-	return winio.DialPipe(pipePath, nil)
+func DialPipe(home *Home) (net.Conn, error) {
+	return winio.DialPipe(pipePath(home), nil)
 }
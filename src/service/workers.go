@@ -0,0 +1,75 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Worker pools:
+Incoming datagrams are handled by fixed numbers of workers per traffic class, so that a flood of one class
+neither spawns unbounded goroutines nor delays other classes. Responses in particular are never queued behind
+requests. When a queue is full the datagram is dropped and counted instead of blocking the read loop.
+*/
+
+// probeWorkers handles probe requests. Their delayed responses are scheduled rather than waited for, see reProbe.
+const probeWorkers = 2
+
+// WorkerPool handles datagrams of a traffic class. The handler owns the datagram it is given, see pool.go.
+type WorkerPool struct {
+	Name    string
+	queue   chan *Datagram
+	handler func(*Datagram)
+	handled uint64
+	dropped uint64
+	workers sync.WaitGroup
+}
+
+// PoolStats is a snapshot of a WorkerPool's counters.
+type PoolStats struct {
+	Name    string
+	Queued  int
+	Handled uint64
+	Dropped uint64
+}
+
+// newWorkerPool creates a pool and starts its workers.
+func newWorkerPool(name string, workers, queueLength int, handler func(*Datagram)) *WorkerPool {
+	pool := &WorkerPool{Name: name, queue: make(chan *Datagram, queueLength), handler: handler}
+	pool.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// submit queues a datagram without blocking. If the queue is full, the datagram is dropped and released.
+func (pool *WorkerPool) submit(datagram *Datagram) bool {
+	select {
+	case pool.queue <- datagram:
+		return true
+	default:
+		atomic.AddUint64(&pool.dropped, 1)
+		datagram.Release()
+		return false
+	}
+}
+
+func (pool *WorkerPool) work() {
+	defer pool.workers.Done()
+	for datagram := range pool.queue {
+		pool.handler(datagram)
+		atomic.AddUint64(&pool.handled, 1)
+	}
+}
+
+// stop handles what is queued, then stops the workers. Nothing may be submitted afterwards.
+func (pool *WorkerPool) stop() {
+	close(pool.queue)
+	pool.workers.Wait()
+}
+
+// Stats returns the pool's counters.
+func (pool *WorkerPool) Stats() PoolStats {
+	return PoolStats{pool.Name, len(pool.queue), atomic.LoadUint64(&pool.handled), atomic.LoadUint64(&pool.dropped)}
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestWorkerPoolDrops(t *testing.T) {
+	release := make(chan struct{})
+	pool := newWorkerPool("test", 1, 2, func(datagram *Datagram) {
+		<-release
+		datagram.Release()
+	})
+	// The worker holds the first datagram, two wait in the queue, and the rest are dropped.
+	pool.submit(AcquireDatagram())
+	waitFor(t, "the worker taking a datagram", func() bool { return pool.Stats().Queued == 0 })
+	for i := 0; i < 5; i++ {
+		if accepted := pool.submit(AcquireDatagram()); accepted != (i < 2) {
+			t.Fatalf("datagram %d accepted: %t", i, accepted)
+		}
+	}
+	if stats := pool.Stats(); stats.Queued != 2 || stats.Dropped != 3 {
+		t.Fatalf("%d queued, %d dropped", stats.Queued, stats.Dropped)
+	}
+	close(release)
+	pool.stop()
+	if stats := pool.Stats(); stats.Handled != 3 || stats.Dropped != 3 {
+		t.Fatalf("%d handled, %d dropped", stats.Handled, stats.Dropped)
+	}
+}
+
+func TestDispatchTrafficClasses(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Port = 0
+	cfg.PortMapping = false
+	cfg.STUNServers = nil
+	server := NewServer(NewBucketTree(cfg), cfg)
+	if server == nil {
+		t.Fatal("failed to create server")
+	}
+	server.StartService()
+	defer server.Stop(context.Background())
+
+	source := &Node{ID: NewRandNodeID(), Address: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}
+	for _, datagram := range []*Datagram{
+		NewDatagram(server.Clock, Ping, true, NewRandCookie(), source, NewPing(nil)),
+		NewDatagram(server.Clock, FindNode, true, NewRandCookie(), source, NewFindNode(true, source.ID, nil)),
+		NewDatagram(server.Clock, Ping, false, NewRandCookie(), source, NewPing(nil)),
+		NewDatagram(server.Clock, Connect, true, NewRandCookie(), source, NewConnect(NewRandNodeID())),
+		NewDatagram(server.Clock, RelayData, true, NewRandCookie(), source, NewRelayData(NewRandNodeID(), make([]byte, HeaderLength))),
+		NewDatagram(server.Clock, Probe, true, NewRandCookie(), source, NewProbe(true, 0)),
+	} {
+		loaded := AcquireDatagram()
+		if err := loaded.Loads(datagram.Dumps(), source.Address); err != nil {
+			t.Fatal(err)
+		}
+		server.dispatch(loaded)
+	}
+
+	// Each class goes to its own pool. Every sender is welcomed except for a ping responder and a prober.
+	want := map[string]uint64{"responses": 1, "requests": 2, "punches": 1, "relays": 1, "probes": 1, "welcomes": 4}
+	waitFor(t, "datagrams handled", func() bool {
+		for _, stats := range server.PoolStats() {
+			if stats.Handled != want[stats.Name] {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XMPP namespaces used here, see RFC 6120.
+const (
+	nsStreams = "http://etherx.jabber.org/streams"
+	nsClient  = "jabber:client"
+	nsTLS     = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	nsBind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	nsSignal  = "urn:rumor:signal"
+)
+
+// XMPPAccount is an XMPP account used by a node for signalling.
+type XMPPAccount struct {
+	JID      string // user@domain
+	Password string
+	// Server is the host:port to dial. If empty, SRV record of the domain or domain:5222 is used.
+	Server string
+	// TLSConfig is used for STARTTLS. If nil, a default one verifying the domain is used.
+	TLSConfig *tls.Config
+	// AllowPlain allows authenticating without TLS when the server does not offer STARTTLS.
+	// Only meant for local servers.
+	AllowPlain bool
+}
+
+// JIDAddr is an XMPP address. It implements net.Addr so that it could be an Endpoint of a node.
+type JIDAddr string
+
+// Network returns the network name.
+func (jid JIDAddr) Network() string {
+	return "xmpp"
+}
+
+func (jid JIDAddr) String() string {
+	return string(jid)
+}
+
+// Domain returns the domain part of a JID.
+func (jid JIDAddr) Domain() string {
+	str := string(jid)
+	if i := strings.IndexByte(str, '@'); i >= 0 {
+		str = str[i+1:]
+	}
+	if i := strings.IndexByte(str, '/'); i >= 0 {
+		str = str[:i]
+	}
+	return str
+}
+
+// Bare returns the JID without resource.
+func (jid JIDAddr) Bare() JIDAddr {
+	str := string(jid)
+	if i := strings.IndexByte(str, '/'); i >= 0 {
+		str = str[:i]
+	}
+	return JIDAddr(str)
+}
+
+type xmppFeatures struct {
+	XMLName    xml.Name  `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+	Bind       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+type xmppBindResult struct {
+	XMLName xml.Name `xml:"jabber:client iq"`
+	Type    string   `xml:"type,attr"`
+	JID     string   `xml:"urn:ietf:params:xml:ns:xmpp-bind bind>jid"`
+}
+
+type xmppMessage struct {
+	XMLName xml.Name `xml:"jabber:client message"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Offer   string   `xml:"urn:rumor:signal offer"`
+}
+
+// XMPPClient is a minimal XMPP client able to exchange rumor signalling messages.
+type XMPPClient struct {
+	JID       JIDAddr // Full JID bound by the server.
+	conn      net.Conn
+	decoder   *xml.Decoder
+	writeLock *sync.Mutex
+}
+
+// DialXMPP logs into an XMPP account: STARTTLS, SASL PLAIN, and resource binding.
+func DialXMPP(account *XMPPAccount, timeout time.Duration) (*XMPPClient, error) {
+	jid := JIDAddr(account.JID)
+	domain := jid.Domain()
+	user := strings.SplitN(string(jid.Bare()), "@", 2)[0]
+	if domain == "" || user == "" || user == string(jid.Bare()) {
+		return nil, fmt.Errorf("illegal jid %s", account.JID)
+	}
+	serverAddr := account.Server
+	if serverAddr == "" {
+		serverAddr = net.JoinHostPort(domain, "5222")
+		if _, srvs, err := net.LookupSRV("xmpp-client", "tcp", domain); err == nil && len(srvs) > 0 {
+			serverAddr = net.JoinHostPort(strings.TrimSuffix(srvs[0].Target, "."), fmt.Sprint(srvs[0].Port))
+		}
+	}
+	conn, err := net.DialTimeout("tcp", serverAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := &XMPPClient{conn: conn, writeLock: &sync.Mutex{}}
+	if err = client.login(account, user, domain); err != nil {
+		client.conn.Close()
+		return nil, err
+	}
+	client.conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// login negotiates the stream until a resource is bound.
+func (client *XMPPClient) login(account *XMPPAccount, user, domain string) error {
+	features, err := client.openStream(domain)
+	if err != nil {
+		return err
+	}
+	if features.StartTLS != nil {
+		if err = client.send(fmt.Sprintf(`<starttls xmlns='%s'/>`, nsTLS)); err != nil {
+			return err
+		}
+		start, err := client.nextElement()
+		if err != nil {
+			return err
+		}
+		if start.Name.Local != "proceed" {
+			return errors.New("xmpp server refused starttls")
+		}
+		tlsConfig := account.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: domain}
+		}
+		tlsConn := tls.Client(client.conn, tlsConfig)
+		if err = tlsConn.Handshake(); err != nil {
+			return err
+		}
+		client.conn = tlsConn
+		if features, err = client.openStream(domain); err != nil {
+			return err
+		}
+	} else if !account.AllowPlain {
+		return errors.New("xmpp server does not offer starttls")
+	}
+
+	supportPlain := false
+	for _, mechanism := range features.Mechanisms {
+		supportPlain = supportPlain || mechanism == "PLAIN"
+	}
+	if !supportPlain {
+		return errors.New("xmpp server does not support PLAIN authentication")
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + account.Password))
+	if err = client.send(fmt.Sprintf(`<auth xmlns='%s' mechanism='PLAIN'>%s</auth>`, nsSASL, auth)); err != nil {
+		return err
+	}
+	start, err := client.nextElement()
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "success" {
+		return errors.New("xmpp authentication failed")
+	}
+	if err = client.decoder.Skip(); err != nil {
+		return err
+	}
+
+	if features, err = client.openStream(domain); err != nil {
+		return err
+	}
+	if features.Bind == nil {
+		return errors.New("xmpp server does not offer resource binding")
+	}
+	if err = client.send(fmt.Sprintf(`<iq type='set' id='bind1'><bind xmlns='%s'><resource>rumor</resource></bind></iq>`, nsBind)); err != nil {
+		return err
+	}
+	start, err = client.nextElement()
+	if err != nil {
+		return err
+	}
+	var result xmppBindResult
+	if err = client.decoder.DecodeElement(&result, &start); err != nil {
+		return err
+	}
+	if result.Type != "result" || result.JID == "" {
+		return errors.New("xmpp resource binding failed")
+	}
+	client.JID = JIDAddr(result.JID)
+	return client.send(`<presence/>`)
+}
+
+// openStream opens a new stream and reads its features.
+func (client *XMPPClient) openStream(domain string) (*xmppFeatures, error) {
+	header := fmt.Sprintf(`<?xml version='1.0'?><stream:stream to='%s' version='1.0' xmlns='%s' xmlns:stream='%s'>`, domain, nsClient, nsStreams)
+	if err := client.send(header); err != nil {
+		return nil, err
+	}
+	client.decoder = xml.NewDecoder(client.conn)
+	start, err := client.nextElement()
+	if err != nil {
+		return nil, err
+	}
+	if start.Name.Space != nsStreams || start.Name.Local != "stream" {
+		return nil, errors.New("illegal xmpp stream header")
+	}
+	if start, err = client.nextElement(); err != nil {
+		return nil, err
+	}
+	var features xmppFeatures
+	if err = client.decoder.DecodeElement(&features, &start); err != nil {
+		return nil, err
+	}
+	return &features, nil
+}
+
+// nextElement returns the next start element, skipping everything else.
+func (client *XMPPClient) nextElement() (xml.StartElement, error) {
+	for {
+		token, err := client.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Space == nsStreams && t.Name.Local == "stream" {
+				return xml.StartElement{}, io.EOF
+			}
+		}
+	}
+}
+
+// send writes raw XML to the stream.
+func (client *XMPPClient) send(raw string) error {
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+	_, err := io.WriteString(client.conn, raw)
+	return err
+}
+
+// SendOffer sends a signalling offer to a JID.
+func (client *XMPPClient) SendOffer(to JIDAddr, offer []byte) error {
+	bytes, err := xml.Marshal(&xmppMessage{To: string(to), Type: "normal", Offer: base64.StdEncoding.EncodeToString(offer)})
+	if err != nil {
+		return err
+	}
+	return client.send(string(bytes))
+}
+
+// ReceiveOffer blocks until a signalling offer arrives. Other stanzas are ignored.
+func (client *XMPPClient) ReceiveOffer() (JIDAddr, []byte, error) {
+	for {
+		start, err := client.nextElement()
+		if err != nil {
+			return "", nil, err
+		}
+		if start.Name.Space != nsClient || start.Name.Local != "message" {
+			if err = client.decoder.Skip(); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		var msg xmppMessage
+		if err = client.decoder.DecodeElement(&msg, &start); err != nil {
+			return "", nil, err
+		}
+		if msg.Offer == "" {
+			continue
+		}
+		offer, err := base64.StdEncoding.DecodeString(strings.TrimSpace(msg.Offer))
+		if err != nil {
+			continue
+		}
+		return JIDAddr(msg.From), offer, nil
+	}
+}
+
+// Close closes the stream and the connection.
+func (client *XMPPClient) Close() error {
+	client.send(`</stream:stream>`)
+	return client.conn.Close()
+}
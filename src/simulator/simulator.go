@@ -0,0 +1,448 @@
+// Package simulator runs many nodes in one process over an in-memory network with a virtual clock,
+// so that routing tables, lookups and churn resilience are evaluated without deploying machines.
+package simulator
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"service"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Virtual time moves from one scheduled function to the next, such as a packet arrival. After each of them the
+// nodes run until quiet, that is, nothing is sent, received or scheduled during settleRounds yields in a row, so
+// that a run follows the seed rather than how fast the machine is.
+const (
+	settleRounds = 64
+	joinBatch    = 32 // Nodes joining at once.
+)
+
+// Scenario scripts a simulation.
+type Scenario struct {
+	Seed     int64
+	Nodes    int    // Nodes joining at the beginning.
+	Steps    []Step // Run in order after the initial nodes joined.
+	Latency  time.Duration
+	Jitter   time.Duration
+	Loss     float64
+	NATRatio float64         // Fraction of nodes behind NATs, the first node is always public.
+	NATType  service.NATType // Type of the NATs.
+	Config   *service.Config // Config of every node, see DefaultConfig.
+}
+
+// Step is a point of the script.
+type Step struct {
+	After   time.Duration // Virtual time since the previous step.
+	Join    int
+	Leave   int
+	Lookups int
+}
+
+// ChurnSteps returns n steps every interval. Each of them replaces churn of nodes, then runs lookups.
+func ChurnSteps(n int, interval time.Duration, nodes int, churn float64, lookups int) []Step {
+	replaced := int(float64(nodes) * churn)
+	steps := make([]Step, n)
+	for i := range steps {
+		steps[i] = Step{interval, replaced, replaced, lookups}
+	}
+	return steps
+}
+
+// DefaultConfig returns the node config tuned for simulation: single workers, no STUN, port mapping or
+// keepalives. Requests time out within seconds, so that lookups pass over departed nodes quickly.
+// Eviction pings are stateless, since a full bucket would otherwise hold the tree lock while virtual time stands still.
+func DefaultConfig() *service.Config {
+	cfg := service.DefaultConfig()
+	cfg.RequestTimeout = 2
+	cfg.StatelessCookies = true
+	cfg.Readers, cfg.BatchSize = 1, 1
+	cfg.ResponseWorkers, cfg.RequestWorkers, cfg.RelayWorkers = 1, 1, 1
+	cfg.STUNServers = nil
+	cfg.NetworkCheckInterval = 3600
+	cfg.PortMapping = false
+	cfg.KeepaliveContacts = 0
+	cfg.KeepaliveMinLifetime, cfg.KeepaliveMaxProbe = 3600, 3600
+	return cfg
+}
+
+// Simulator runs a scenario.
+type Simulator struct {
+	Clock    *service.FakeClock
+	Network  *service.MemNetwork
+	scenario *Scenario
+	rand     *rand.Rand
+	nodes    []*Node // Every node ever joined.
+	alive    []*Node
+	stats    lookupStats
+	activity uint64 // Packets sent and received by all nodes.
+}
+
+// Node is a simulated node.
+type Node struct {
+	Server *service.Server
+	Alive  bool
+	conn   *countingConn
+}
+
+type lookupStats struct {
+	lookups   int
+	succeeded int
+	hops      []int // Number of successful lookups by hops.
+	rounds    int
+	failed    int
+	lock      sync.Mutex
+}
+
+// countingConn counts traffic of a node, and of all nodes in activity.
+type countingConn struct {
+	net.PacketConn
+	sent, sentBytes, received, receivedBytes uint64
+	activity                                 *uint64
+}
+
+func (conn *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := conn.PacketConn.ReadFrom(b)
+	if err == nil {
+		atomic.AddUint64(&conn.received, 1)
+		atomic.AddUint64(conn.activity, 1)
+		atomic.AddUint64(&conn.receivedBytes, uint64(n))
+	}
+	return n, addr, err
+}
+
+func (conn *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := conn.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		atomic.AddUint64(&conn.sent, 1)
+		atomic.AddUint64(conn.activity, 1)
+		atomic.AddUint64(&conn.sentBytes, uint64(n))
+	}
+	return n, err
+}
+
+// New creates a simulator of a scenario.
+func New(scenario *Scenario) *Simulator {
+	if scenario.Config == nil {
+		scenario.Config = DefaultConfig()
+	}
+	clock := service.NewFakeClock(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	network := service.NewMemNetwork(scenario.Seed)
+	network.Clock = clock
+	network.Latency, network.Jitter, network.Loss = scenario.Latency, scenario.Jitter, scenario.Loss
+	return &Simulator{Clock: clock, Network: network, scenario: scenario, rand: rand.New(rand.NewSource(scenario.Seed))}
+}
+
+// Run runs the scenario, stops all nodes and reports.
+func (sim *Simulator) Run() (*Report, error) {
+	start := sim.Clock.Now()
+	if err := sim.Join(sim.scenario.Nodes); err != nil {
+		return nil, err
+	}
+	for _, step := range sim.scenario.Steps {
+		sim.Wait(step.After)
+		sim.Leave(step.Leave)
+		if err := sim.Join(step.Join); err != nil {
+			return nil, err
+		}
+		sim.Lookups(step.Lookups)
+	}
+	report := sim.Report()
+	report.Duration = sim.Clock.Now().Sub(start)
+	sim.Close()
+	return report, nil
+}
+
+// Join adds n nodes in batches. Each node bootstraps from an alive node by looking itself up.
+// The first node of the network bootstraps from nobody.
+func (sim *Simulator) Join(n int) error {
+	for n > 0 {
+		batch := service.Min(n, joinBatch)
+		if len(sim.alive) == 0 {
+			batch = 1
+		}
+		n -= batch
+		bootstraps := append([]*Node{}, sim.alive...)
+		nodes := make([]*Node, batch)
+		for i := range nodes {
+			node, err := sim.newNode()
+			if err != nil {
+				return err
+			}
+			nodes[i] = node
+		}
+		sim.parallel(batch, func(i int) {
+			node := nodes[i]
+			node.Server.StartService()
+			if len(bootstraps) == 0 {
+				return
+			}
+			bootstrap := bootstraps[i%len(bootstraps)].Server.KBuckets.Self
+			node.Server.KBuckets.Add(bootstrap.ID, bootstrap.Address)
+			node.Server.Lookup(node.Server.KBuckets.Self.ID)
+		})
+		sim.alive = append(sim.alive, nodes...)
+	}
+	return nil
+}
+
+// newNode creates a node on the next free address, behind a NAT at the chance of NATRatio.
+func (sim *Simulator) newNode() (*Node, error) {
+	i := uint32(len(sim.nodes) + 1)
+	addr := &net.UDPAddr{IP: ipOf(10, i), Port: 54321}
+	cfg := *sim.scenario.Config
+	var nat *service.MemNAT
+	if len(sim.nodes) > 0 && sim.rand.Float64() < sim.scenario.NATRatio {
+		var err error
+		nat, err = sim.Network.NewNAT(sim.scenario.NATType, ipOf(20, i), 0)
+		if err != nil {
+			return nil, err
+		}
+		addr.IP = ipOf(192, i)
+		// The first node is public, and answers STUN binding requests as every node does.
+		cfg.STUNServers = []string{sim.nodes[0].Server.KBuckets.SelfNode().Address.String()}
+	}
+	memConn, err := sim.Network.Listen(addr, nat)
+	if err != nil {
+		return nil, err
+	}
+	conn := &countingConn{PacketConn: memConn, activity: &sim.activity}
+	tree := service.NewBucketTree(&cfg)
+	var id service.NodeID
+	sim.rand.Read(id[:])
+	tree.Self.ID = &id
+	server := service.NewServerOn(tree, &cfg, sim.Clock, conn)
+	if server == nil {
+		return nil, fmt.Errorf("failed to create node %d", i)
+	}
+	node := &Node{Server: server, Alive: true, conn: conn}
+	sim.nodes = append(sim.nodes, node)
+	return node, nil
+}
+
+// ipOf returns the i-th address in a /8 network.
+func ipOf(network byte, i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	ip[0] = network
+	return ip
+}
+
+// Leave stops n random alive nodes.
+func (sim *Simulator) Leave(n int) {
+	n = service.Min(n, len(sim.alive))
+	sim.rand.Shuffle(len(sim.alive), func(i, j int) {
+		sim.alive[i], sim.alive[j] = sim.alive[j], sim.alive[i]
+	})
+	leaving := sim.alive[:n]
+	sim.alive = append([]*Node{}, sim.alive[n:]...)
+	sim.parallel(len(leaving), func(i int) {
+		leaving[i].Alive = false
+		leaving[i].Server.Stop(context.Background())
+	})
+}
+
+// Lookups runs n lookups at once, each from a random alive node for another random alive one.
+func (sim *Simulator) Lookups(n int) {
+	if len(sim.alive) < 2 {
+		return
+	}
+	sources, targets := make([]*Node, n), make([]*Node, n)
+	for i := 0; i < n; i++ {
+		sources[i] = sim.alive[sim.rand.Intn(len(sim.alive))]
+		for targets[i] = sources[i]; targets[i] == sources[i]; {
+			targets[i] = sim.alive[sim.rand.Intn(len(sim.alive))]
+		}
+	}
+	sim.parallel(n, func(i int) {
+		target := targets[i].Server.KBuckets.Self.ID
+		result := sources[i].Server.Lookup(target)
+		sim.stats.add(result, result.Found(target))
+	})
+}
+
+func (stats *lookupStats) add(result *service.LookupResult, found bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.lookups++
+	stats.rounds += result.Rounds
+	stats.failed += result.Failed
+	if !found {
+		return
+	}
+	stats.succeeded++
+	for len(stats.hops) <= result.Hops {
+		stats.hops = append(stats.hops, 0)
+	}
+	stats.hops[result.Hops]++
+}
+
+// Wait lets d of virtual time pass.
+func (sim *Simulator) Wait(d time.Duration) {
+	end := sim.Clock.Now().Add(d)
+	for sim.step(end) {
+	}
+}
+
+// parallel runs f(0) to f(n-1) at once, and drives the clock until all of them return.
+func (sim *Simulator) parallel(n int, f func(i int)) {
+	var returned int32
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer atomic.AddInt32(&returned, 1)
+			f(i)
+		}(i)
+	}
+	sim.settle()
+	for atomic.LoadInt32(&returned) < int32(n) {
+		if next, ok := sim.Clock.Next(); ok {
+			sim.step(next)
+		} else {
+			sim.settle() // Still busy without waiting for anything.
+		}
+	}
+}
+
+// step advances the clock to the next scheduled function, then lets the nodes settle. If nothing is scheduled
+// until end, the clock advances to end and false is returned.
+func (sim *Simulator) step(end time.Time) bool {
+	now := sim.Clock.Now()
+	next, ok := sim.Clock.Next()
+	if !ok || next.After(end) {
+		if now.Before(end) {
+			sim.Clock.Advance(end.Sub(now))
+			sim.settle()
+		}
+		return false
+	}
+	sim.Clock.Advance(next.Sub(now))
+	sim.settle()
+	return true
+}
+
+// settle yields to the nodes until they are quiet, see settleRounds.
+func (sim *Simulator) settle() {
+	last := sim.activityCount()
+	for quiet := 0; quiet < settleRounds; {
+		runtime.Gosched()
+		if current := sim.activityCount(); current != last {
+			last, quiet = current, 0
+		} else {
+			quiet++
+		}
+	}
+}
+
+// activityCount grows whenever a node sends, receives or schedules something.
+func (sim *Simulator) activityCount() uint64 {
+	return atomic.LoadUint64(&sim.activity) + uint64(sim.Clock.Pending())
+}
+
+// Close stops all alive nodes.
+func (sim *Simulator) Close() {
+	sim.Leave(len(sim.alive))
+}
+
+// Report summarizes a simulation.
+type Report struct {
+	Nodes     int // Nodes ever joined.
+	Alive     int
+	Duration  time.Duration // Virtual time.
+	Lookups   int
+	Succeeded int
+	Hops      []int   // Number of successful lookups by hops.
+	Rounds    float64 // Mean rounds per lookup.
+	Failed    float64 // Mean unresponsive nodes per lookup.
+	// Traffic per node.
+	Sent, Received           Traffic
+	SentBytes, ReceivedBytes Traffic
+}
+
+// Traffic is a distribution of traffic among nodes.
+type Traffic struct {
+	Mean   float64
+	Median uint64
+	Max    uint64
+}
+
+// Report reports what has happened so far.
+func (sim *Simulator) Report() *Report {
+	sim.stats.lock.Lock()
+	report := &Report{Nodes: len(sim.nodes), Alive: len(sim.alive), Lookups: sim.stats.lookups, Succeeded: sim.stats.succeeded,
+		Hops: append([]int{}, sim.stats.hops...)}
+	if sim.stats.lookups > 0 {
+		report.Rounds = float64(sim.stats.rounds) / float64(sim.stats.lookups)
+		report.Failed = float64(sim.stats.failed) / float64(sim.stats.lookups)
+	}
+	sim.stats.lock.Unlock()
+	counters := func(counter func(conn *countingConn) *uint64) Traffic {
+		values := make([]uint64, len(sim.nodes))
+		for i, node := range sim.nodes {
+			values[i] = atomic.LoadUint64(counter(node.conn))
+		}
+		return distribution(values)
+	}
+	report.Sent = counters(func(conn *countingConn) *uint64 { return &conn.sent })
+	report.Received = counters(func(conn *countingConn) *uint64 { return &conn.received })
+	report.SentBytes = counters(func(conn *countingConn) *uint64 { return &conn.sentBytes })
+	report.ReceivedBytes = counters(func(conn *countingConn) *uint64 { return &conn.receivedBytes })
+	return report
+}
+
+func distribution(values []uint64) Traffic {
+	if len(values) == 0 {
+		return Traffic{}
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	var sum uint64
+	for _, value := range values {
+		sum += value
+	}
+	return Traffic{float64(sum) / float64(len(values)), values[len(values)/2], values[len(values)-1]}
+}
+
+// SuccessRate returns the fraction of lookups finding their targets.
+func (report *Report) SuccessRate() float64 {
+	if report.Lookups == 0 {
+		return 0
+	}
+	return float64(report.Succeeded) / float64(report.Lookups)
+}
+
+// MeanHops returns the mean hops of successful lookups.
+func (report *Report) MeanHops() float64 {
+	if report.Succeeded == 0 {
+		return 0
+	}
+	sum := 0
+	for hops, count := range report.Hops {
+		sum += hops * count
+	}
+	return float64(sum) / float64(report.Succeeded)
+}
+
+func (report *Report) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Nodes: %d joined, %d alive after %s\n", report.Nodes, report.Alive, report.Duration)
+	fmt.Fprintf(&builder, "Lookups: %d, %.1f%% succeeded, %.2f hops, %.2f rounds, %.2f unresponsive nodes on average\n",
+		report.Lookups, report.SuccessRate()*100, report.MeanHops(), report.Rounds, report.Failed)
+	fmt.Fprintf(&builder, "Hops:")
+	for hops, count := range report.Hops {
+		fmt.Fprintf(&builder, " %d:%d", hops, count)
+	}
+	fmt.Fprintf(&builder, "\nTraffic per node     %10s %10s %10s\n", "mean", "median", "max")
+	for _, row := range []struct {
+		name    string
+		traffic Traffic
+	}{{"packets sent", report.Sent}, {"packets received", report.Received}, {"bytes sent", report.SentBytes}, {"bytes received", report.ReceivedBytes}} {
+		fmt.Fprintf(&builder, "  %-18s %10.1f %10d %10d\n", row.name, row.traffic.Mean, row.traffic.Median, row.traffic.Max)
+	}
+	return builder.String()
+}
@@ -0,0 +1,45 @@
+package simulator
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// scenario is small enough to run in a test, with churn between the lookups.
+func scenario() *Scenario {
+	return &Scenario{Seed: 7, Nodes: 30, Steps: ChurnSteps(1, time.Minute, 30, 0.1, 20),
+		Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond}
+}
+
+func TestScenario(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	report, err := New(scenario()).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Nodes != 33 || report.Alive != 30 || report.Lookups != 20 {
+		t.Fatalf("%d nodes joined, %d alive, %d lookups", report.Nodes, report.Alive, report.Lookups)
+	}
+	if report.SuccessRate() != 1 {
+		t.Fatalf("%d of %d lookups succeeded", report.Succeeded, report.Lookups)
+	}
+	// Most nodes know each other in a network this small.
+	if !reflect.DeepEqual(report.Hops, []int{8, 10, 2}) {
+		t.Fatalf("hops: %v", report.Hops)
+	}
+
+	// The same seed reproduces the lookups. Goroutines handling the same packet may still interleave differently,
+	// so that traffic could differ by a packet.
+	again, err := New(scenario()).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Succeeded != report.Succeeded || !reflect.DeepEqual(again.Hops, report.Hops) {
+		t.Fatalf("rerun differs: %d succeeded, hops %v", again.Succeeded, again.Hops)
+	}
+}